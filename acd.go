@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Address conflict detection (RFC 5227)
+
+// acdProbe enables probing the addresses before using them and announcing them
+var acdProbe bool
+
+// acdDefend enables defending the addresses against conflicting ARP packets
+var acdDefend bool
+
+// timing constants of RFC 5227 section 1.1
+const (
+	ACD_PROBE_WAIT        = 1 * time.Second
+	ACD_PROBE_NUM         = 3
+	ACD_PROBE_MIN         = 1 * time.Second
+	ACD_PROBE_MAX         = 2 * time.Second
+	ACD_ANNOUNCE_WAIT     = 2 * time.Second
+	ACD_ANNOUNCE_NUM      = 2
+	ACD_ANNOUNCE_INTERVAL = 2 * time.Second
+	ACD_DEFEND_INTERVAL   = 10 * time.Second
+	// probing is retried at most once per ACD_RATE_LIMIT_INTERVAL after ACD_MAX_CONFLICTS conflicts
+	ACD_MAX_CONFLICTS       = 10
+	ACD_RATE_LIMIT_INTERVAL = 60 * time.Second
+)
+
+type acdPhase uint8
+
+const (
+	// probing is not started yet
+	acdPhaseInit acdPhase = iota
+	acdPhaseProbing
+	acdPhaseAnnouncing
+	acdPhaseBound
+	// another host has the address and the router does not use it until probing again
+	acdPhaseConflict
+)
+
+var acdPhaseNames = map[acdPhase]string{
+	acdPhaseInit:       "init",
+	acdPhaseProbing:    "probing",
+	acdPhaseAnnouncing: "announcing",
+	acdPhaseBound:      "bound",
+	acdPhaseConflict:   "conflict",
+}
+
+func (phase acdPhase) String() string {
+	return acdPhaseNames[phase]
+}
+
+type acdState struct {
+	phase acdPhase
+	// the number of probes or announcements sent in the phase
+	sent int
+	next time.Time
+
+	lastDefend   time.Time
+	conflicts    int
+	conflictMac  [6]uint8
+	lastConflict time.Time
+}
+
+var (
+	acdMu sync.Mutex
+	// acdStates by the device which probes its address or has seen a conflict
+	acdStates = map[*netDevice]*acdState{}
+)
+
+var metricArpAddressConflicts = newCounterVec(
+	"curo_arp_address_conflicts_total",
+	"Number of ARP packets from other hosts claiming the address of the router.",
+	"device",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricArpAddressConflicts)
+	registerHTTPHandler("/acd", acdHandler)
+	registerTimerHook(acdTick)
+}
+
+// acdStart starts probing the address of netdev when it is set or changed.
+// The state of the previous address is discarded.
+func acdStart(netdev *netDevice) {
+	acdMu.Lock()
+	defer acdMu.Unlock()
+	delete(acdStates, netdev)
+	if !acdProbe || netdev.ipdev().address == 0 {
+		return
+	}
+	acdStates[netdev] = &acdState{phase: acdPhaseInit}
+}
+
+// acdAddressUsable returns false while the address of netdev is probed or conflicts
+func acdAddressUsable(netdev *netDevice) bool {
+	acdMu.Lock()
+	defer acdMu.Unlock()
+	state, ok := acdStates[netdev]
+	if !ok {
+		return true
+	}
+	return state.phase == acdPhaseAnnouncing || state.phase == acdPhaseBound
+}
+
+func randomDuration(min, max time.Duration) time.Duration {
+	return min + time.Duration(rand.Int63n(int64(max-min)+1))
+}
+
+// acdTick sends the probes and the announcements which are due
+func acdTick(now time.Time) {
+	acdMu.Lock()
+	defer acdMu.Unlock()
+
+	for netdev, state := range acdStates {
+		if state.phase == acdPhaseInit {
+			state.phase = acdPhaseProbing
+			state.next = now.Add(randomDuration(0, ACD_PROBE_WAIT))
+			continue
+		}
+		if now.Before(state.next) {
+			continue
+		}
+
+		switch state.phase {
+		case acdPhaseConflict:
+			log.Printf("Probing %s on %s again after %d conflicts", netdev.ipdev().address, netdev.name, state.conflicts)
+			state.phase = acdPhaseProbing
+			state.sent = 0
+			state.next = now.Add(randomDuration(0, ACD_PROBE_WAIT))
+		case acdPhaseProbing:
+			if state.sent < ACD_PROBE_NUM {
+				if err := sendArpProbe(netdev); err != nil {
+					log.Printf("failed to send ARP probe on %s: %v", netdev.name, err)
+				}
+				state.sent++
+				if state.sent < ACD_PROBE_NUM {
+					state.next = now.Add(randomDuration(ACD_PROBE_MIN, ACD_PROBE_MAX))
+				} else {
+					state.next = now.Add(ACD_ANNOUNCE_WAIT)
+				}
+				continue
+			}
+			log.Printf("No conflict of %s on %s, announcing", netdev.ipdev().address, netdev.name)
+			state.phase = acdPhaseAnnouncing
+			state.sent = 0
+			fallthrough
+		case acdPhaseAnnouncing:
+			if err := sendGratuitousArp(netdev); err != nil {
+				log.Printf("failed to announce %s on %s: %v", netdev.ipdev().address, netdev.name, err)
+			}
+			state.sent++
+			state.next = now.Add(ACD_ANNOUNCE_INTERVAL)
+			if state.sent >= ACD_ANNOUNCE_NUM {
+				state.phase = acdPhaseBound
+			}
+		}
+	}
+}
+
+// acdCheckConflict watches the ARP packet received on netdev for other hosts claiming its address
+func acdCheckConflict(netdev *netDevice, arp arpIPToEthernet) {
+	address := netdev.ipdev().address
+	if address == 0 || arp.senderHardwareAddr == netdev.macaddr {
+		return
+	}
+
+	acdMu.Lock()
+	defer acdMu.Unlock()
+	state, ok := acdStates[netdev]
+	if !ok {
+		// the address is watched without probing
+		state = &acdState{phase: acdPhaseBound}
+	}
+
+	conflict := arp.senderIPAddr == address
+	// another host probing the same address at the same time
+	if state.phase == acdPhaseProbing && arp.opcode == ARP_OPERATION_CODE_REQUEST &&
+		arp.senderIPAddr == 0 && arp.targetIPAddr == address {
+		conflict = true
+	}
+	if !conflict {
+		return
+	}
+	acdStates[netdev] = state
+
+	now := clock.Now()
+	state.conflicts++
+	state.conflictMac = arp.senderHardwareAddr
+	state.lastConflict = now
+	metricArpAddressConflicts.inc(netdev.name)
+	log.Printf("address conflict on %s: %s is claimed by %s (%s)",
+		netdev.name, address, net.HardwareAddr(arp.senderHardwareAddr[:]), state.phase)
+
+	switch state.phase {
+	case acdPhaseInit, acdPhaseProbing:
+		state.phase = acdPhaseConflict
+		state.next = now
+		if state.conflicts >= ACD_MAX_CONFLICTS {
+			state.next = now.Add(ACD_RATE_LIMIT_INTERVAL)
+		}
+	case acdPhaseAnnouncing, acdPhaseBound:
+		if !acdDefend {
+			return
+		}
+		if !state.lastDefend.IsZero() && now.Sub(state.lastDefend) < ACD_DEFEND_INTERVAL {
+			log.Printf("address conflict on %s again within %s, not defending", netdev.name, ACD_DEFEND_INTERVAL)
+			return
+		}
+		state.lastDefend = now
+		if err := sendGratuitousArp(netdev); err != nil {
+			log.Printf("failed to defend %s on %s: %v", address, netdev.name, err)
+		}
+	}
+}
+
+// sendArpProbe sends the ARP request for the address of netdev without the sender address
+func sendArpProbe(netdev *netDevice) error {
+	log.Printf("Sending ARP probe via %s for %s", netdev.name, netdev.ipdev().address)
+
+	arpPacket := arpIPToEthernet{
+		hardwareType:       ARP_HTYPE_ETHERNET,
+		protocolType:       ETHER_TYPE_IP,
+		hardwareLen:        ETHERNET_ADDRESS_LEN,
+		protocolLen:        IpAddressLen,
+		opcode:             ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr: netdev.macaddr,
+		senderIPAddr:       0,
+		targetHardwareAddr: [6]uint8{},
+		targetIPAddr:       netdev.ipdev().address,
+	}
+
+	if err := arpOutput(netdev, ETHERNET_ADDERSS_BROADCAST, arpPacket); err != nil {
+		return fmt.Errorf("failed to send ethernet packet: %w", err)
+	}
+	metricArpPackets.inc("tx", arpOperationName(ARP_OPERATION_CODE_REQUEST))
+
+	return nil
+}
+
+// acdHandler shows the conflict detection state of the devices
+func acdHandler(w http.ResponseWriter, _ *http.Request) {
+	acdMu.Lock()
+	defer acdMu.Unlock()
+	for _, netdev := range netDeviceList {
+		state, ok := acdStates[netdev]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "%s %s %s conflicts=%d", netdev.name, netdev.ipdev().address, state.phase, state.conflicts)
+		if state.conflicts > 0 {
+			fmt.Fprintf(w, " last=%s by=%s", state.lastConflict.Format(time.RFC3339), net.HardwareAddr(state.conflictMac[:]))
+		}
+		fmt.Fprintln(w)
+	}
+}
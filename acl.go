@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// aclFile is the file of the access control lists.
+// Each line is a rule appended to the list of the interface and direction:
+//
+//	<interface> <in|out> <permit|deny|reject|log> [match...]
+//
+// Match fields:
+//
+//	proto tcp|udp|icmp|N, src ADDR/PREFIX, dst ADDR/PREFIX,
+//	src-port N[-M], dst-port N[-M], icmp-type N, dscp N, tos N, in-interface IF
+//
+// The rules are evaluated in order and the first permit, deny or reject rule is applied.
+// reject denies the packet and sends ICMP administratively prohibited.
+// log logs the packet and continues the evaluation.
+// A packet which matches no rule is denied.
+var aclFile string
+
+type aclAction uint8
+
+const (
+	aclActionPermit aclAction = iota
+	aclActionDeny
+	aclActionReject
+	aclActionLog
+)
+
+var aclActionNames = map[aclAction]string{
+	aclActionPermit: "permit",
+	aclActionDeny:   "deny",
+	aclActionReject: "reject",
+	aclActionLog:    "log",
+}
+
+func (action aclAction) String() string {
+	return aclActionNames[action]
+}
+
+type aclDirection uint8
+
+const (
+	aclDirectionIn aclDirection = iota
+	aclDirectionOut
+)
+
+func (dir aclDirection) String() string {
+	if dir == aclDirectionOut {
+		return "out"
+	}
+	return "in"
+}
+
+// aclRule matches the fields which are set
+type aclRule struct {
+	seq    int
+	action aclAction
+	// the line of the rule in aclFile
+	text string
+
+	srcAddr    IpAddress
+	srcNetmask uint32
+	dstAddr    IpAddress
+	dstNetmask uint32
+
+	matchProtocol bool
+	protocol      uint8
+
+	srcPortMin, srcPortMax uint16
+	dstPortMin, dstPortMax uint16
+	matchSrcPort           bool
+	matchDstPort           bool
+
+	matchICMPType bool
+	icmpType      uint8
+
+	matchDSCP bool
+	dscp      uint8
+	matchTOS  bool
+	tos       uint8
+
+	inputdev string
+}
+
+type accessList struct {
+	netdev *netDevice
+	dir    aclDirection
+	rules  []*aclRule
+}
+
+var (
+	// access lists by the attached device
+	aclIngress = map[*netDevice]*accessList{}
+	aclEgress  = map[*netDevice]*accessList{}
+)
+
+var metricACLMatches = newCounterVec(
+	"curo_acl_matches_total",
+	"Number of packets matched by access control list rules.",
+	"device", "direction", "seq", "action",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricACLMatches)
+}
+
+// setupAccessLists loads aclFile and attaches the lists to the devices in netDeviceList
+func setupAccessLists() error {
+	if aclFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(aclFile)
+	if err != nil {
+		return fmt.Errorf("failed to open ACL file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return fmt.Errorf("%s:%d: expected <interface> <in|out> <action> [match...]", aclFile, lineNum)
+		}
+
+		netdev := lookupNetDevice(fields[0])
+		if netdev == nil {
+			return fmt.Errorf("%s:%d: device %s is not found", aclFile, lineNum, fields[0])
+		}
+		lists := aclIngress
+		dir := aclDirectionIn
+		switch fields[1] {
+		case "in":
+		case "out":
+			lists = aclEgress
+			dir = aclDirectionOut
+		default:
+			return fmt.Errorf("%s:%d: unknown direction: %s", aclFile, lineNum, fields[1])
+		}
+
+		rule, err := parseACLRule(fields[2:])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", aclFile, lineNum, err)
+		}
+		rule.text = line
+
+		acl, ok := lists[netdev]
+		if !ok {
+			acl = &accessList{netdev: netdev, dir: dir}
+			lists[netdev] = acl
+		}
+		rule.seq = len(acl.rules) + 1
+		acl.rules = append(acl.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ACL file: %w", err)
+	}
+
+	for _, lists := range []map[*netDevice]*accessList{aclIngress, aclEgress} {
+		for netdev, acl := range lists {
+			log.Printf("Set ACL with %d rules on %s %s", len(acl.rules), netdev.name, acl.dir)
+		}
+	}
+	return nil
+}
+
+func parseACLRule(fields []string) (*aclRule, error) {
+	rule := &aclRule{}
+	switch fields[0] {
+	case "permit":
+		rule.action = aclActionPermit
+	case "deny":
+		rule.action = aclActionDeny
+	case "reject":
+		rule.action = aclActionReject
+	case "log":
+		rule.action = aclActionLog
+	default:
+		return nil, fmt.Errorf("unknown action: %s", fields[0])
+	}
+
+	fields = fields[1:]
+	if len(fields) == 1 && fields[0] == "any" {
+		return rule, nil
+	}
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("match fields must be pairs of name and value")
+	}
+	for i := 0; i < len(fields); i += 2 {
+		name, value := fields[i], fields[i+1]
+		var err error
+		switch name {
+		case "proto":
+			rule.matchProtocol = true
+			rule.protocol, err = parseIPProtocol(value)
+		case "src":
+			rule.srcAddr, rule.srcNetmask, err = parsePrefix(value)
+		case "dst":
+			rule.dstAddr, rule.dstNetmask, err = parsePrefix(value)
+		case "src-port":
+			rule.matchSrcPort = true
+			rule.srcPortMin, rule.srcPortMax, err = parsePortRange(value)
+		case "dst-port":
+			rule.matchDstPort = true
+			rule.dstPortMin, rule.dstPortMax, err = parsePortRange(value)
+		case "icmp-type":
+			rule.matchICMPType = true
+			rule.icmpType, err = parseUint8(value)
+		case "dscp":
+			rule.matchDSCP = true
+			rule.dscp, err = parseUint8(value)
+			if err == nil && rule.dscp > 63 {
+				err = fmt.Errorf("invalid DSCP: %s", value)
+			}
+		case "tos":
+			rule.matchTOS = true
+			rule.tos, err = parseUint8(value)
+		case "in-interface":
+			rule.inputdev = value
+		default:
+			err = fmt.Errorf("unknown match field: %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// match returns true when all the fields set in the rule match the packet
+func (rule *aclRule) match(info *packetInfo, inputdev *netDevice) bool {
+	if uint32(info.ip.srcAddr)&rule.srcNetmask != uint32(rule.srcAddr)&rule.srcNetmask {
+		return false
+	}
+	if uint32(info.ip.destAddr)&rule.dstNetmask != uint32(rule.dstAddr)&rule.dstNetmask {
+		return false
+	}
+	if rule.matchProtocol && info.ip.protocol != rule.protocol {
+		return false
+	}
+	if rule.matchSrcPort && (!info.hasPorts || info.srcPort < rule.srcPortMin || info.srcPort > rule.srcPortMax) {
+		return false
+	}
+	if rule.matchDstPort && (!info.hasPorts || info.dstPort < rule.dstPortMin || info.dstPort > rule.dstPortMax) {
+		return false
+	}
+	if rule.matchICMPType && (!info.hasICMP || info.icmpType != rule.icmpType) {
+		return false
+	}
+	if rule.matchDSCP && info.ip.tos>>2 != rule.dscp {
+		return false
+	}
+	if rule.matchTOS && info.ip.tos != rule.tos {
+		return false
+	}
+	if rule.inputdev != "" && (inputdev == nil || inputdev.name != rule.inputdev) {
+		return false
+	}
+	return true
+}
+
+// evaluate returns the action applied to the packet.
+// inputdev is the device the packet was received on, or nil for packets sent by the router.
+func (acl *accessList) evaluate(info *packetInfo, inputdev *netDevice) aclAction {
+	for _, rule := range acl.rules {
+		if !rule.match(info, inputdev) {
+			continue
+		}
+		metricACLMatches.inc(acl.netdev.name, acl.dir.String(), strconv.Itoa(rule.seq), rule.action.String())
+		if rule.action == aclActionLog {
+			log.Printf("ACL %s %s rule %d: proto=%d from=%s:%d to=%s:%d",
+				acl.netdev.name, acl.dir, rule.seq, info.ip.protocol,
+				info.ip.srcAddr, info.srcPort, info.ip.destAddr, info.dstPort,
+			)
+			continue
+		}
+		return rule.action
+	}
+
+	// implicit deny
+	metricACLMatches.inc(acl.netdev.name, acl.dir.String(), "implicit", aclActionDeny.String())
+	return aclActionDeny
+}
+
+// aclCheckIngress returns true when the IP packet received on inputdev is permitted
+func aclCheckIngress(inputdev *netDevice, ipheader *ipHeader, packet []byte) bool {
+	acl, ok := aclIngress[inputdev]
+	if !ok {
+		return true
+	}
+
+	var info packetInfo
+	info.parseIP(packet)
+	switch acl.evaluate(&info, inputdev) {
+	case aclActionPermit:
+		return true
+	case aclActionReject:
+		if err := icmpSendError(inputdev, ipheader, packet,
+			ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_ADMINISTRATIVELY_PROHIBITED, 0); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	dropPacket(inputdev, dropReasonACLDenied, packet)
+	return false
+}
+
+// aclCheckEgress returns true when the IP packet is permitted to be sent from outputdev.
+// inputdev is the device the forwarded packet was received on, nil for the packets sent by the router.
+func aclCheckEgress(outputdev, inputdev *netDevice, packet []byte) bool {
+	acl, ok := aclEgress[outputdev]
+	if !ok {
+		return true
+	}
+
+	var info packetInfo
+	info.parseIP(packet)
+	switch acl.evaluate(&info, inputdev) {
+	case aclActionPermit:
+		return true
+	case aclActionReject:
+		// the packet sent by the router is not answered with ICMP
+		if inputdev != nil {
+			if err := icmpSendError(inputdev, &info.ip, packet,
+				ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_ADMINISTRATIVELY_PROHIBITED, 0); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+	outputdev.stats.txDropped.Add(1)
+	return false
+}
+
+// parsePrefix parses ADDR/PREFIX or ADDR, which is the same as ADDR/32
+func parsePrefix(s string) (IpAddress, uint32, error) {
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil || ipnet.IP.To4() == nil {
+		return 0, 0, fmt.Errorf("invalid prefix: %s", s)
+	}
+	return IpAddress(byteToUint32(ipnet.IP.To4())), byteToUint32(ipnet.Mask), nil
+}
+
+// parsePortRange parses N or N-M
+func parsePortRange(s string) (uint16, uint16, error) {
+	minstr, maxstr, ok := strings.Cut(s, "-")
+	if !ok {
+		maxstr = minstr
+	}
+	min, err := strconv.ParseUint(minstr, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	max, err := strconv.ParseUint(maxstr, 10, 16)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+func parseIPProtocol(s string) (uint8, error) {
+	switch s {
+	case "icmp":
+		return IpProtocolNumICMP, nil
+	case "tcp":
+		return IpProtocolNumTCP, nil
+	case "udp":
+		return IpProtocolNumUDP, nil
+	}
+	return parseUint8(s)
+}
+
+func parseUint8(s string) (uint8, error) {
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", s)
+	}
+	return uint8(v), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+// The IPv4 address changes of the interfaces are received by worker 0 from a rtnetlink socket.
+// A device has one address, so the address added last replaces the previous one.
+
+// RTMGRP_IPV4_IFADDR is the multicast group of the IPv4 address notifications
+const RTMGRP_IPV4_IFADDR = 0x10
+
+// addressWatchSocket is the rtnetlink socket notified of the address changes, -1 when not watched
+var addressWatchSocket = -1
+
+// setAddress sets the address of netdev and starts probing it for conflicts
+func (netdev *netDevice) setAddress(ipdev ipDevice) {
+	netdev.ipdevice.Store(&ipdev)
+	acdStart(netdev)
+}
+
+// setupAddressWatch opens the rtnetlink socket notified of the IPv4 address changes
+// and monitors it by epfd
+func setupAddressWatch(epfd int) error {
+	sock, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to create netlink socket: %w", err)
+	}
+	if err := syscall.Bind(sock, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: RTMGRP_IPV4_IFADDR,
+	}); err != nil {
+		if cerr := syscall.Close(sock); cerr != nil {
+			log.Printf("failed to close netlink socket: %v", cerr)
+		}
+		return fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, sock, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(sock),
+	}); err != nil {
+		if cerr := syscall.Close(sock); cerr != nil {
+			log.Printf("failed to close netlink socket: %v", cerr)
+		}
+		return fmt.Errorf("failed to epoll ctrl: %w", err)
+	}
+	addressWatchSocket = sock
+	registerShutdownHook("address watch", func() error {
+		return syscall.Close(sock)
+	})
+	return nil
+}
+
+// pollAddressChanges applies the address changes received on addressWatchSocket
+func pollAddressChanges() error {
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := syscall.Recvfrom(addressWatchSocket, buf, 0)
+		if err != nil {
+			switch err {
+			case syscall.EAGAIN, syscall.EINTR:
+				return nil
+			case syscall.ENOBUFS:
+				// the notifications overflowed the socket buffer and are lost
+				log.Printf("address change notifications are lost, the addresses may be outdated")
+				continue
+			}
+			return fmt.Errorf("failed to receive address changes: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse netlink message: %w", err)
+		}
+		for i := range msgs {
+			msg := &msgs[i]
+			if msg.Header.Type != syscall.RTM_NEWADDR && msg.Header.Type != syscall.RTM_DELADDR {
+				continue
+			}
+			if len(msg.Data) < syscall.SizeofIfAddrmsg {
+				continue
+			}
+			ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+			if ifa.Family != syscall.AF_INET {
+				continue
+			}
+			netdev := lookupNetDeviceByIndex(int(ifa.Index))
+			if netdev == nil {
+				continue
+			}
+			address, ok := ifAddrmsgAddress(msg)
+			if !ok {
+				continue
+			}
+			netdev.addressChanged(msg.Header.Type == syscall.RTM_NEWADDR, address, ifa.Prefixlen)
+		}
+	}
+}
+
+// ifAddrmsgAddress returns the local address of the address message
+func ifAddrmsgAddress(msg *syscall.NetlinkMessage) (IpAddress, bool) {
+	attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+	if err != nil {
+		return 0, false
+	}
+	var address []byte
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFA_LOCAL:
+			address = attr.Value
+		case syscall.IFA_ADDRESS:
+			// the peer address on point-to-point links, the local address otherwise
+			if address == nil {
+				address = attr.Value
+			}
+		}
+	}
+	if len(address) != IpAddressLen {
+		return 0, false
+	}
+	return IpAddress(byteToUint32(address)), true
+}
+
+// addressChanged replaces the address of netdev and its connected route
+func (netdev *netDevice) addressChanged(added bool, address IpAddress, prefixLen uint8) {
+	old := netdev.ipdev()
+	if !added {
+		if address != old.address {
+			return
+		}
+		log.Printf("Removed address %s from %s", address, netdev.name)
+		removeConnectedRoute(netdev)
+		netdev.setAddress(ipDevice{})
+		return
+	}
+
+	netmask := ^uint32(0) << (32 - uint32(prefixLen))
+	if address == old.address && netmask == old.netmask {
+		return
+	}
+	log.Printf("Set address %s/%d on %s", address, prefixLen, netdev.name)
+	if old.address != 0 {
+		removeConnectedRoute(netdev)
+	}
+	netdev.setAddress(ipDevice{
+		address:   address,
+		netmask:   netmask,
+		broadcast: IpAddress(uint32(address) | ^netmask),
+	})
+	addConnectedRoute(netdev)
+}
+
+// lookupNetDeviceByIndex returns the netDevice bound to the interface index
+func lookupNetDeviceByIndex(ifindex int) *netDevice {
+	for _, netdev := range netDeviceList {
+		if !netdev.virtual && netdev.sockaddr.Ifindex == ifindex {
+			return netdev
+		}
+	}
+	return nil
+}
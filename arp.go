@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 const (
@@ -14,7 +15,26 @@ const (
 
 const ARP_HTYPE_ETHERNET uint16 = 1
 
-var ArpTableEntryList []arpTableEntry
+// the ARP cache is sharded by the address so that the workers rarely contend for a lock
+const arpCacheShards = 16
+
+type arpCacheShard struct {
+	mu      sync.RWMutex
+	entries map[IpAddress]*arpTableEntry
+}
+
+var arpCache [arpCacheShards]arpCacheShard
+
+func init() {
+	for i := range arpCache {
+		arpCache[i].entries = make(map[IpAddress]*arpTableEntry)
+	}
+}
+
+func arpCacheShardOf(ipaddr IpAddress) *arpCacheShard {
+	// the host part varies the most within a subnet
+	return &arpCache[uint32(ipaddr)%arpCacheShards]
+}
 
 type arpIPToEthernet struct {
 	hardwareType       uint16
@@ -32,51 +52,72 @@ type arpTableEntry struct {
 	macAddr [6]uint8
 	ipAddr  IpAddress
 	netdev  *netDevice
+	// when the entry was last confirmed by an ARP packet, zero if learned from IP
+	confirmed time.Time
 }
 
 func (msg arpIPToEthernet) ToPacket() []byte {
-	var b bytes.Buffer
-	b.Write(uint16ToBytes(msg.hardwareType))
-	b.Write(uint16ToBytes(msg.protocolType))
-	b.Write([]byte{msg.hardwareLen})
-	b.Write([]byte{msg.protocolLen})
-	b.Write(uint16ToBytes(msg.opcode))
-	b.Write(macToByte(msg.senderHardwareAddr))
-	b.Write(uint32ToBytes(uint32(msg.senderIPAddr)))
-	b.Write(macToByte(msg.targetHardwareAddr))
-	b.Write(uint32ToBytes(uint32(msg.targetIPAddr)))
+	b := make([]byte, ARP_PACKET_LEN)
+	msg.encode(b)
+	return b
+}
+
+// arpOutput encodes the ARP message behind the headroom of the ethernet header and sends it to destAddr
+func arpOutput(netdev *netDevice, destAddr [6]uint8, msg arpIPToEthernet) error {
+	pb := getPacketBuffer(ETHERNET_HEADER_LEN, ARP_PACKET_LEN)
+	defer pb.free()
+	msg.encode(pb.append(ARP_PACKET_LEN))
+	return ethernetOutputBuffer(netdev, destAddr, pb, ETHER_TYPE_ARP)
+}
 
-	return b.Bytes()
+// parseArpPacket parses the ARP packet. The packet must be at least 28 bytes.
+func parseArpPacket(packet []byte) arpIPToEthernet {
+	v := arpView(packet)
+	return arpIPToEthernet{
+		hardwareType:       v.hardwareType(),
+		protocolType:       v.protocolType(),
+		hardwareLen:        v.hardwareLen(),
+		protocolLen:        v.protocolLen(),
+		opcode:             v.opcode(),
+		senderHardwareAddr: v.senderHardwareAddr(),
+		senderIPAddr:       v.senderIPAddr(),
+		targetHardwareAddr: v.targetHardwareAddr(),
+		targetIPAddr:       v.targetIPAddr(),
+	}
 }
 
 // arpInput receives the ARP packet
-func arpInput(netdev *netDevice, packet []byte) error {
+func arpInput(netdev *netDevice, ethHeader ethernetHeader, packet []byte) error {
 	if len(packet) < 28 {
+		dropPacket(netdev, dropReasonArpTooShort, packet)
 		return fmt.Errorf("invalid ARP packet: length is too short (length=%d)", len(packet))
 	}
 
-	arpMsg := arpIPToEthernet{
-		hardwareType:       byteToUint16(packet[0:2]),
-		protocolType:       byteToUint16(packet[2:4]),
-		hardwareLen:        packet[4],
-		protocolLen:        packet[5],
-		opcode:             byteToUint16(packet[6:8]),
-		senderHardwareAddr: setMacAddr(packet[8:14]),
-		senderIPAddr:       IpAddress(byteToUint32(packet[14:18])),
-		targetHardwareAddr: setMacAddr(packet[18:24]),
-		targetIPAddr:       IpAddress(byteToUint32(packet[24:28])),
-	}
+	arpMsg := parseArpPacket(packet)
 
 	if arpMsg.protocolType != ETHER_TYPE_IP {
+		dropPacket(netdev, dropReasonArpUnsupportedProtocol, packet)
 		return fmt.Errorf("unexpected protocol type: %d", arpMsg.protocolType)
 	}
 	if arpMsg.hardwareLen != ETHERNET_ADDRESS_LEN {
+		dropPacket(netdev, dropReasonArpInvalidHardwareLen, packet)
 		return fmt.Errorf("invalid hardware address length: %d", arpMsg.hardwareLen)
 	}
 	if arpMsg.protocolLen != IpAddressLen {
+		dropPacket(netdev, dropReasonArpInvalidProtocolLen, packet)
 		return fmt.Errorf("invalid protocol address length: %d", arpMsg.protocolLen)
 	}
 
+	metricArpPackets.inc("rx", arpOperationName(arpMsg.opcode))
+
+	if !coppCheck(netdev, coppClassARP, packet) {
+		return nil
+	}
+	acdCheckConflict(netdev, arpMsg)
+	if !arpInspect(netdev, ethHeader, arpMsg, packet) {
+		return nil
+	}
+
 	switch arpMsg.opcode {
 	case ARP_OPERATION_CODE_REQUEST:
 		fmt.Printf("received the ARP request packet: %+v\n", arpMsg)
@@ -86,6 +127,8 @@ func arpInput(netdev *netDevice, packet []byte) error {
 	case ARP_OPERATION_CODE_REPLY:
 		fmt.Printf("received the ARP reply packet: %+v\n", arpMsg)
 		ReceiveARPReply(netdev, arpMsg)
+	default:
+		dropPacket(netdev, dropReasonArpUnknownOperation, packet)
 	}
 
 	return nil
@@ -93,20 +136,30 @@ func arpInput(netdev *netDevice, packet []byte) error {
 
 // nolint: unused
 func getArpTableEntry(ipAddr IpAddress) ([6]uint8, *netDevice) {
-	for _, arpTable := range ArpTableEntryList {
-		if arpTable.ipAddr == ipAddr {
-			return arpTable.macAddr, arpTable.netdev
-		}
-	}
-	return [6]uint8{}, nil
+	return searchArpTableEntry(ipAddr)
 }
 
 // ReceiveARPRequest receives the ARP request packet
 func ReceiveARPRequest(netdev *netDevice, arp arpIPToEthernet) error {
-	if netdev.ipdev.address == 0 || netdev.ipdev.address != arp.targetIPAddr {
-		log.Printf("invalid address: %s", netdev.ipdev.address)
+	// the existing entry is updated by any request including gratuitous ARP (RFC 826)
+	if _, ok := lookupArpTableEntry(arp.senderIPAddr); arp.senderIPAddr != 0 && ok {
+		arpLearn(netdev, arp.senderIPAddr, arp.senderHardwareAddr)
+	}
+
+	// the address is not used while probing for the conflict
+	if arp.targetIPAddr == netdev.ipdev().address && !acdAddressUsable(netdev) {
+		dropPacket(netdev, dropReasonArpNotForUs, arp.ToPacket())
 		return nil
 	}
+	if netdev.ipdev().address == 0 || (netdev.ipdev().address != arp.targetIPAddr && !proxyArpTarget(netdev, arp)) {
+		log.Printf("invalid address: %s", netdev.ipdev().address)
+		dropPacket(netdev, dropReasonArpNotForUs, arp.ToPacket())
+		return nil
+	}
+
+	if arp.senderIPAddr != 0 {
+		arpLearn(netdev, arp.senderIPAddr, arp.senderHardwareAddr)
+	}
 
 	fmt.Printf("Sending ARP reply to %s\n", arp.targetIPAddr)
 	arpPacket := arpIPToEthernet{
@@ -116,53 +169,90 @@ func ReceiveARPRequest(netdev *netDevice, arp arpIPToEthernet) error {
 		protocolLen:        IpAddressLen,
 		opcode:             ARP_OPERATION_CODE_REPLY,
 		senderHardwareAddr: netdev.macaddr,
-		senderIPAddr:       netdev.ipdev.address,
+		senderIPAddr:       arp.targetIPAddr,
 		targetHardwareAddr: arp.senderHardwareAddr,
 		targetIPAddr:       arp.senderIPAddr,
-	}.ToPacket()
+	}
 
-	if err := ethernetOutput(netdev, arp.senderHardwareAddr, arpPacket, ETHER_TYPE_ARP); err != nil {
+	if err := arpOutput(netdev, arp.senderHardwareAddr, arpPacket); err != nil {
 		return fmt.Errorf("failed to output ethernet: %v", err)
 	}
+	metricArpPackets.inc("tx", arpOperationName(ARP_OPERATION_CODE_REPLY))
 	return nil
 }
 
 // ReceiveARPReply receives the ARP request packet
 func ReceiveARPReply(netdev *netDevice, arp arpIPToEthernet) {
-
+	if arp.senderIPAddr != 0 {
+		arpLearn(netdev, arp.senderIPAddr, arp.senderHardwareAddr)
+	}
 }
 
 func searchArpTableEntry(ipaddr IpAddress) ([6]uint8, *netDevice) {
-	for _, arpTable := range ArpTableEntryList {
-		if arpTable.ipAddr == IpAddress(ipaddr) {
-			return arpTable.macAddr, arpTable.netdev
-		}
+	entry, _ := lookupArpTableEntry(ipaddr)
+	return entry.macAddr, entry.netdev
+}
+
+// lookupArpTableEntry returns a copy of the entry of the address
+func lookupArpTableEntry(ipaddr IpAddress) (arpTableEntry, bool) {
+	shard := arpCacheShardOf(ipaddr)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if entry, ok := shard.entries[ipaddr]; ok {
+		return *entry, true
 	}
-	return [6]uint8{}, nil
+	return arpTableEntry{}, false
 }
 
-func addArpTableEntry(netdev *netDevice, ipaddr IpAddress, macaddr [6]uint8) {
-	for _, arpTable := range ArpTableEntryList {
-		if arpTable.ipAddr == IpAddress(ipaddr) && arpTable.macAddr != macaddr {
-			arpTable.macAddr = macaddr
-		}
-		if arpTable.macAddr == macaddr && arpTable.ipAddr != IpAddress(ipaddr) {
-			arpTable.ipAddr = IpAddress(ipaddr)
-		}
-		if arpTable.macAddr == macaddr && arpTable.ipAddr == IpAddress(ipaddr) {
-			return
-		}
+// updateArpTableEntry calls update with the entry of the address under the lock of its shard.
+// The entry is zero except ipAddr when exists is false, and it is stored only when update returns true.
+// The packets waiting for the address are sent once it is resolved.
+func updateArpTableEntry(ipaddr IpAddress, update func(entry *arpTableEntry, exists bool) bool) bool {
+	macaddr, updated := updateArpCacheShard(ipaddr, update)
+	if updated && macaddr != [6]uint8{0, 0, 0, 0, 0, 0} {
+		arpFlushPending(ipaddr, macaddr)
+	}
+	return updated
+}
+
+// updateArpCacheShard updates the entry for updateArpTableEntry and returns its MAC address
+func updateArpCacheShard(ipaddr IpAddress, update func(entry *arpTableEntry, exists bool) bool) ([6]uint8, bool) {
+	shard := arpCacheShardOf(ipaddr)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[ipaddr]
+	if !exists {
+		entry = &arpTableEntry{ipAddr: ipaddr}
 	}
+	if !update(entry, exists) {
+		return [6]uint8{}, false
+	}
+	if !exists {
+		shard.entries[ipaddr] = entry
+		metricArpCacheEntries.inc()
+	}
+	return entry.macAddr, true
+}
 
-	ArpTableEntryList = append(ArpTableEntryList, arpTableEntry{
-		macAddr: macaddr,
-		ipAddr:  IpAddress(ipaddr),
-		netdev:  netdev,
+// addArpTableEntry adds or updates the entry of the address.
+// confirmed is true when the entry is learned from an ARP packet.
+func addArpTableEntry(netdev *netDevice, ipaddr IpAddress, macaddr [6]uint8, confirmed bool) {
+	updateArpTableEntry(ipaddr, func(entry *arpTableEntry, exists bool) bool {
+		entry.macAddr = macaddr
+		entry.netdev = netdev
+		if confirmed {
+			entry.confirmed = clock.Now()
+		}
+		return true
 	})
 }
 
-// nolint:unused
+// sendArpRequest sends the ARP request for the target from the address of netdev.
+// Nothing is sent until the address is announced.
 func sendArpRequest(netdev *netDevice, targetip IpAddress) error {
+	if !acdAddressUsable(netdev) {
+		return nil
+	}
 	log.Printf("Sending arp request via %s for %x", netdev.name, targetip)
 
 	arpPacket := arpIPToEthernet{
@@ -172,14 +262,39 @@ func sendArpRequest(netdev *netDevice, targetip IpAddress) error {
 		protocolLen:        IpAddressLen,
 		opcode:             ARP_OPERATION_CODE_REQUEST,
 		senderHardwareAddr: netdev.macaddr,
-		senderIPAddr:       netdev.ipdev.address,
+		senderIPAddr:       netdev.ipdev().address,
 		targetHardwareAddr: ETHERNET_ADDERSS_BROADCAST,
 		targetIPAddr:       targetip,
-	}.ToPacket()
+	}
+
+	if err := arpOutput(netdev, ETHERNET_ADDERSS_BROADCAST, arpPacket); err != nil {
+		return fmt.Errorf("failed to send ethernet packet: %w", err)
+	}
+	metricArpPackets.inc("tx", arpOperationName(ARP_OPERATION_CODE_REQUEST))
+
+	return nil
+}
+
+// sendGratuitousArp announces the address of netdev to the link
+func sendGratuitousArp(netdev *netDevice) error {
+	log.Printf("Sending gratuitous arp via %s for %s", netdev.name, netdev.ipdev().address)
+
+	arpPacket := arpIPToEthernet{
+		hardwareType:       ARP_HTYPE_ETHERNET,
+		protocolType:       ETHER_TYPE_IP,
+		hardwareLen:        ETHERNET_ADDRESS_LEN,
+		protocolLen:        IpAddressLen,
+		opcode:             ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr: netdev.macaddr,
+		senderIPAddr:       netdev.ipdev().address,
+		targetHardwareAddr: [6]uint8{},
+		targetIPAddr:       netdev.ipdev().address,
+	}
 
-	if err := ethernetOutput(netdev, ETHERNET_ADDERSS_BROADCAST, arpPacket, ETHER_TYPE_ARP); err != nil {
+	if err := arpOutput(netdev, ETHERNET_ADDERSS_BROADCAST, arpPacket); err != nil {
 		return fmt.Errorf("failed to send ethernet packet: %w", err)
 	}
+	metricArpPackets.inc("tx", arpOperationName(ARP_OPERATION_CODE_REQUEST))
 
 	return nil
 }
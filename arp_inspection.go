@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// arpInspectionInterfaces are the interfaces whose ARP senders are validated against the bindings
+var arpInspectionInterfaces []string
+
+// arpBindingFile is the file of the static bindings. Each line is
+//
+//	<interface> <address> <macaddr>
+var arpBindingFile string
+
+// arpLeaseFile is the dnsmasq lease file. Each line is
+//
+//	<expiry> <macaddr> <address> <hostname> <client-id>
+//
+// The lease is bound to the interface whose subnet has the address.
+var arpLeaseFile string
+
+// arpLearnFromIP enables learning the ARP cache from the source of received IP packets
+var arpLearnFromIP = true
+
+// arpConfirmHold is how long the MAC address of a confirmed entry cannot be changed
+var arpConfirmHold = 60 * time.Second
+
+// arpBindingTable is the bound MAC addresses by the device name and the address
+type arpBindingTable map[string]map[IpAddress][6]uint8
+
+var arpBindings atomic.Pointer[arpBindingTable]
+
+var metricArpConflicts = newCounterVec(
+	"curo_arp_conflicts_total",
+	"Number of ARP cache updates rejected by the inspection.",
+	"device", "reason",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricArpConflicts)
+	registerHTTPHandler("/arp/bindings/reload", arpBindingsReloadHandler)
+}
+
+// setupArpInspection enables the inspection on the interfaces and loads the bindings
+func setupArpInspection() error {
+	for _, name := range arpInspectionInterfaces {
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("device %s is not found", name)
+		}
+		netdev.arpInspection = true
+		log.Printf("Enabled ARP inspection on %s", name)
+	}
+	return loadArpBindings()
+}
+
+// loadArpBindings reads arpBindingFile and arpLeaseFile and replaces the bindings
+func loadArpBindings() error {
+	table := arpBindingTable{}
+	if arpBindingFile != "" {
+		if err := table.readStatic(arpBindingFile); err != nil {
+			return err
+		}
+	}
+	if arpLeaseFile != "" {
+		if err := table.readLeases(arpLeaseFile); err != nil {
+			return err
+		}
+	}
+	arpBindings.Store(&table)
+	return nil
+}
+
+func (table arpBindingTable) add(netdev *netDevice, addr IpAddress, macaddr [6]uint8) {
+	if table[netdev.name] == nil {
+		table[netdev.name] = map[IpAddress][6]uint8{}
+	}
+	table[netdev.name][addr] = macaddr
+}
+
+func (table arpBindingTable) readStatic(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open ARP binding file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected <interface> <address> <macaddr>", path, lineNum)
+		}
+		netdev := lookupNetDevice(fields[0])
+		if netdev == nil {
+			return fmt.Errorf("%s:%d: device %s is not found", path, lineNum, fields[0])
+		}
+		addr, macaddr, err := parseArpBinding(fields[1], fields[2])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		table.add(netdev, addr, macaddr)
+	}
+	return scanner.Err()
+}
+
+func (table arpBindingTable) readLeases(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open DHCP lease file: %w", err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid expiry: %s", path, lineNum, fields[0])
+		}
+		// 0 is an infinite lease
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+		addr, macaddr, err := parseArpBinding(fields[2], fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		for _, netdev := range netDeviceList {
+			if netdev.ipdev().address != 0 && uint32(addr)&netdev.ipdev().netmask == uint32(netdev.ipdev().address)&netdev.ipdev().netmask {
+				table.add(netdev, addr, macaddr)
+				break
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func parseArpBinding(addrstr, macstr string) (IpAddress, [6]uint8, error) {
+	ip := net.ParseIP(addrstr).To4()
+	if ip == nil {
+		return 0, [6]uint8{}, fmt.Errorf("invalid address: %s", addrstr)
+	}
+	macaddr, err := net.ParseMAC(macstr)
+	if err != nil || len(macaddr) != ETHERNET_ADDRESS_LEN {
+		return 0, [6]uint8{}, fmt.Errorf("invalid MAC address: %s", macstr)
+	}
+	return IpAddress(byteToUint32(ip)), setMacAddr(macaddr), nil
+}
+
+// arpInspect returns false when the sender of the ARP packet received on an inspected
+// interface is not bound to the MAC address
+func arpInspect(netdev *netDevice, ethHeader ethernetHeader, arp arpIPToEthernet, packet []byte) bool {
+	if !netdev.arpInspection {
+		return true
+	}
+	// the probe has no sender address
+	if arp.senderIPAddr == 0 {
+		return true
+	}
+
+	macaddr, ok := (*arpBindings.Load())[netdev.name][arp.senderIPAddr]
+	if ok && macaddr == arp.senderHardwareAddr && macaddr == ethHeader.srcAddr {
+		return true
+	}
+	log.Printf("ARP inspection failed on %s: %s is-at %s (bound to %s)",
+		netdev.name, arp.senderIPAddr,
+		net.HardwareAddr(arp.senderHardwareAddr[:]), net.HardwareAddr(macaddr[:]))
+	metricArpConflicts.inc(netdev.name, "binding_mismatch")
+	dropPacket(netdev, dropReasonArpInspectionFailed, packet)
+	return false
+}
+
+// arpLearn adds the entry to the ARP cache unless it changes the MAC address of
+// an entry confirmed within arpConfirmHold
+func arpLearn(netdev *netDevice, ipaddr IpAddress, macaddr [6]uint8) bool {
+	var confirmedMac [6]uint8
+	learned := updateArpTableEntry(ipaddr, func(entry *arpTableEntry, exists bool) bool {
+		now := clock.Now()
+		if exists && entry.macAddr != macaddr && now.Sub(entry.confirmed) < arpConfirmHold {
+			confirmedMac = entry.macAddr
+			return false
+		}
+		entry.macAddr = macaddr
+		entry.netdev = netdev
+		entry.confirmed = now
+		return true
+	})
+	if !learned {
+		log.Printf("ARP conflict on %s: %s is-at %s, but was confirmed at %s",
+			netdev.name, ipaddr,
+			net.HardwareAddr(macaddr[:]), net.HardwareAddr(confirmedMac[:]))
+		metricArpConflicts.inc(netdev.name, "mac_changed")
+	}
+	return learned
+}
+
+func arpBindingsReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := loadArpBindings(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "reloaded ARP bindings")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// The packets to a next hop whose MAC address is not resolved wait for the ARP reply in a bounded
+// queue per address instead of being dropped (RFC 1122 2.3.2.2). They are sent when the address is
+// learned, and dropped when the queue overflows, the resolution times out or the router shuts down.
+
+const (
+	// arpPendingLimit is the number of the packets queued per unresolved address
+	arpPendingLimit = 3
+	// arpPendingTimeout is how long the packets wait for the ARP reply
+	arpPendingTimeout = 3 * time.Second
+)
+
+type arpPendingPacket struct {
+	outputdev *netDevice
+	// the device the forwarded packet was received on, nil for the packets sent by the router
+	inputdev *netDevice
+	// the IP packet, with the headroom of the ethernet header
+	pb     *packetBuffer
+	queued time.Time
+}
+
+var arpPending = struct {
+	mu     sync.Mutex
+	queues map[IpAddress][]*arpPendingPacket
+}{queues: make(map[IpAddress][]*arpPendingPacket)}
+
+var metricArpPendingPackets = newCounterVec(
+	"curo_arp_pending_packets_total",
+	"Number of the packets queued for an unresolved next hop by the result.",
+	"result",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricArpPendingPackets)
+	registerTimerHook(arpPendingExpire)
+	registerShutdownHook("ARP pending queues", func() error {
+		if n := arpPendingDropAll(); n > 0 {
+			log.Printf("Dropped %d packets waiting for ARP replies", n)
+		}
+		return nil
+	})
+}
+
+// arpQueuePending copies the IP packet to nexthop via outputdev into the queue of the address.
+// The oldest packet is dropped when the queue is full. The packet is sent at once when the address
+// was resolved since the caller looked it up.
+func arpQueuePending(outputdev, inputdev *netDevice, nexthop IpAddress, packet []byte) error {
+	pb := getPacketBuffer(ETHERNET_HEADER_LEN, len(packet))
+	copy(pb.append(len(packet)), packet)
+	pending := &arpPendingPacket{
+		outputdev: outputdev,
+		inputdev:  inputdev,
+		pb:        pb,
+		queued:    clock.Now(),
+	}
+
+	arpPending.mu.Lock()
+	// the entry is learned before its queue is flushed under the lock, so it is not missed
+	if destMacAddr, _ := searchArpTableEntry(nexthop); destMacAddr != [6]uint8{0, 0, 0, 0, 0, 0} {
+		arpPending.mu.Unlock()
+		return pending.send(destMacAddr)
+	}
+	queue := arpPending.queues[nexthop]
+	var overflow *arpPendingPacket
+	if len(queue) >= arpPendingLimit {
+		overflow = queue[0]
+		queue = queue[1:]
+	}
+	arpPending.queues[nexthop] = append(queue, pending)
+	arpPending.mu.Unlock()
+
+	metricArpPendingPackets.inc("queued")
+	if overflow != nil {
+		overflow.drop("overflow")
+	}
+	return nil
+}
+
+// arpFlushPending sends the packets queued for the address which is resolved to macaddr
+func arpFlushPending(ipaddr IpAddress, macaddr [6]uint8) {
+	arpPending.mu.Lock()
+	queue, ok := arpPending.queues[ipaddr]
+	delete(arpPending.queues, ipaddr)
+	arpPending.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, pending := range queue {
+		if err := pending.send(macaddr); err != nil {
+			log.Printf("failed to send packet waiting for %s: %v", ipaddr, err)
+		}
+	}
+}
+
+// arpPendingExpire drops the packets which waited for the ARP reply longer than arpPendingTimeout
+func arpPendingExpire(now time.Time) {
+	var expired []*arpPendingPacket
+	arpPending.mu.Lock()
+	for ipaddr, queue := range arpPending.queues {
+		i := 0
+		for i < len(queue) && now.Sub(queue[i].queued) >= arpPendingTimeout {
+			i++
+		}
+		expired = append(expired, queue[:i]...)
+		if i == len(queue) {
+			delete(arpPending.queues, ipaddr)
+		} else if i > 0 {
+			arpPending.queues[ipaddr] = queue[i:]
+		}
+	}
+	arpPending.mu.Unlock()
+
+	for _, pending := range expired {
+		pending.drop("timeout")
+	}
+}
+
+// arpPendingDropAll drops every queued packet and returns the number of them
+func arpPendingDropAll() int {
+	arpPending.mu.Lock()
+	queues := arpPending.queues
+	arpPending.queues = make(map[IpAddress][]*arpPendingPacket)
+	arpPending.mu.Unlock()
+
+	n := 0
+	for _, queue := range queues {
+		for _, pending := range queue {
+			pending.drop("shutdown")
+			n++
+		}
+	}
+	return n
+}
+
+// send sends the queued packet to destMacAddr, applying the options and the fragmentation of
+// the forwarded packets
+func (pending *arpPendingPacket) send(destMacAddr [6]uint8) error {
+	defer pending.pb.free()
+	metricArpPendingPackets.inc("sent")
+	if pending.inputdev == nil {
+		return ipOutputBuffer(pending.outputdev, destMacAddr, pending.pb)
+	}
+	ipheader := parseIPHeader(pending.pb.bytes())
+	return ipForwardOutput(pending.inputdev, pending.outputdev, destMacAddr, &ipheader, pending.pb)
+}
+
+func (pending *arpPendingPacket) drop(result string) {
+	pending.outputdev.stats.txDropped.Add(1)
+	metricArpPendingPackets.inc(result)
+	pending.pb.free()
+}
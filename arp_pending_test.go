@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// TestArpPendingFlush checks that the packets queued for an unresolved address are sent when
+// it is learned, and that the oldest one is dropped when the queue overflows
+func TestArpPendingFlush(t *testing.T) {
+	outputdev, err := parseReplayDevice("pending-r1=02:00:00:00:03:01,10.98.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nexthop := IpAddress(0x0a620102)
+	t.Cleanup(func() {
+		removeArpTableEntries([]IpAddress{nexthop})
+		arpPendingDropAll()
+	})
+
+	packet := make([]byte, IP_HEADER_LEN)
+	ipHeader{version: 4, headerLen: 5, totalLen: IP_HEADER_LEN, ttl: 64, srcAddr: 0x0a620101, destAddr: nexthop}.encode(packet)
+	for i := 0; i < arpPendingLimit+1; i++ {
+		if err := arpQueuePending(outputdev, nil, nexthop, packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := outputdev.stats.txDropped.Load(); got != 1 {
+		t.Errorf("dropped %d packets on overflow, want 1", got)
+	}
+	if got := outputdev.stats.txPackets.Load(); got != 0 {
+		t.Errorf("sent %d packets before the address is resolved", got)
+	}
+
+	addArpTableEntry(outputdev, nexthop, [6]uint8{0x02, 0x00, 0x00, 0x00, 0x03, 0x02}, true)
+	if got := outputdev.stats.txPackets.Load(); got != arpPendingLimit {
+		t.Errorf("sent %d packets after the address is resolved, want %d", got, arpPendingLimit)
+	}
+	if n := arpPendingDropAll(); n != 0 {
+		t.Errorf("%d packets are left in the queue", n)
+	}
+}
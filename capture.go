@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// captureOptions is the capture started with the router
+var captureOptions captureConfig
+
+// captureDir is the directory the captures started at runtime are written to.
+// Empty disables starting captures at runtime.
+var captureDir string
+
+type captureConfig struct {
+	path string
+	// names of the captured interfaces. Empty means all interfaces.
+	interfaces []string
+	// rotate the file when it exceeds fileSize bytes. 0 disables rotation.
+	fileSize int64
+	// the number of files kept by rotation. 0 keeps all files.
+	fileCount int
+	// only the frames matching the filter are captured
+	filter *packetFilter
+}
+
+// packetCapture writes the frames received and transmitted by the router to pcapng files
+type packetCapture struct {
+	mu        sync.Mutex
+	config    captureConfig
+	selected  map[string]struct{}
+	file      *os.File
+	buf       *bufio.Writer
+	writer    *pcapngWriter
+	fileIndex int
+}
+
+var activeCapture atomic.Pointer[packetCapture]
+
+func init() {
+	registerHTTPHandler("/capture", captureStatusHandler)
+	registerHTTPHandler("/capture/start", captureStartHandler)
+	registerHTTPHandler("/capture/stop", captureStopHandler)
+	registerShutdownHook("capture", stopCapture)
+}
+
+// startCapture starts a capture, replacing the running one
+func startCapture(config captureConfig) error {
+	if config.path == "" {
+		return fmt.Errorf("capture file is not specified")
+	}
+
+	c := &packetCapture{config: config}
+	if len(config.interfaces) > 0 {
+		c.selected = make(map[string]struct{})
+		for _, name := range config.interfaces {
+			c.selected[name] = struct{}{}
+		}
+	}
+	if err := c.openFile(); err != nil {
+		return err
+	}
+
+	if old := activeCapture.Swap(c); old != nil {
+		if err := old.close(); err != nil {
+			log.Printf("failed to close the previous capture: %v", err)
+		}
+	}
+	log.Printf("Started capture to %s", config.path)
+	return nil
+}
+
+// stopCapture stops the running capture and flushes its file
+func stopCapture() error {
+	c := activeCapture.Swap(nil)
+	if c == nil {
+		return nil
+	}
+	log.Printf("Stopped capture to %s", c.config.path)
+	return c.close()
+}
+
+// captureFrame writes the frame to the running capture if netdev is selected
+func captureFrame(netdev *netDevice, data []byte, direction captureDirection) {
+	c := activeCapture.Load()
+	if c == nil {
+		return
+	}
+	if err := c.write(netdev, data, direction); err != nil {
+		log.Printf("failed to capture frame, stopping capture: %v", err)
+		if activeCapture.CompareAndSwap(c, nil) {
+			if err := c.close(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+}
+
+func (c *packetCapture) write(netdev *netDevice, data []byte, direction captureDirection) error {
+	if c.selected != nil {
+		if _, ok := c.selected[netdev.name]; !ok {
+			return nil
+		}
+	}
+	if !c.config.filter.match(data) {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writer == nil {
+		// the capture has been closed
+		return nil
+	}
+	if c.config.fileSize > 0 && c.writer.size >= c.config.fileSize {
+		if err := c.closeFile(); err != nil {
+			return err
+		}
+		c.fileIndex++
+		if err := c.openFile(); err != nil {
+			return err
+		}
+	}
+	return c.writer.writePacket(netdev, clock.Now(), data, direction)
+}
+
+// filePath returns the path of the current file.
+// Rotated files are suffixed with the index in the ring.
+func (c *packetCapture) filePath() string {
+	if c.config.fileSize == 0 {
+		return c.config.path
+	}
+	index := c.fileIndex
+	if c.config.fileCount > 0 {
+		index %= c.config.fileCount
+	}
+	return fmt.Sprintf("%s.%d", c.config.path, index)
+}
+
+func (c *packetCapture) openFile() error {
+	// the symbolic link planted at the path is not followed
+	file, err := os.OpenFile(c.filePath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+	buf := bufio.NewWriter(file)
+	writer, err := newPcapngWriter(buf)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	c.file = file
+	c.buf = buf
+	c.writer = writer
+	return nil
+}
+
+func (c *packetCapture) closeFile() error {
+	if c.writer == nil {
+		return nil
+	}
+	c.writer = nil
+	if err := c.buf.Flush(); err != nil {
+		_ = c.file.Close()
+		return fmt.Errorf("failed to flush capture file: %w", err)
+	}
+	if err := c.file.Close(); err != nil {
+		return fmt.Errorf("failed to close capture file: %w", err)
+	}
+	return nil
+}
+
+func (c *packetCapture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeFile()
+}
+
+// parseInterfaceList parses the comma separated interface names
+func parseInterfaceList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func captureStatusHandler(w http.ResponseWriter, _ *http.Request) {
+	c := activeCapture.Load()
+	if c == nil {
+		fmt.Fprintln(w, "capture is not running")
+		return
+	}
+
+	c.mu.Lock()
+	path := c.filePath()
+	c.mu.Unlock()
+	interfaces := "all"
+	if len(c.config.interfaces) > 0 {
+		interfaces = strings.Join(c.config.interfaces, ",")
+	}
+	fmt.Fprintf(w, "capturing %s to %s", interfaces, path)
+	if c.config.filter != nil {
+		fmt.Fprintf(w, " with filter %q", c.config.filter)
+	}
+	fmt.Fprintln(w)
+}
+
+// captureFilePath returns the path of the capture file name in captureDir.
+// The name must not contain a path separator so that it cannot escape the directory.
+func captureFilePath(name string) (string, error) {
+	if captureDir == "" {
+		return "", fmt.Errorf("starting captures at runtime is disabled, set -capture-dir")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid capture file name: %q", name)
+	}
+	return filepath.Join(captureDir, name), nil
+}
+
+// captureStartHandler starts a capture into captureDir.
+// example: POST /capture/start?file=router1.pcapng&interfaces=router1-host1&size=1000000&files=5&filter=arp
+func captureStartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	path, err := captureFilePath(query.Get("file"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config := captureConfig{
+		path:       path,
+		interfaces: parseInterfaceList(query.Get("interfaces")),
+	}
+	if size := query.Get("size"); size != "" {
+		v, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid size: %v", err), http.StatusBadRequest)
+			return
+		}
+		if v <= 0 {
+			http.Error(w, fmt.Sprintf("invalid size: %d is not positive", v), http.StatusBadRequest)
+			return
+		}
+		config.fileSize = v
+	}
+	filter, err := compilePacketFilter(query.Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config.filter = filter
+	if files := query.Get("files"); files != "" {
+		v, err := strconv.Atoi(files)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid files: %v", err), http.StatusBadRequest)
+			return
+		}
+		if v <= 0 {
+			http.Error(w, fmt.Sprintf("invalid files: %d is not positive", v), http.StatusBadRequest)
+			return
+		}
+		config.fileCount = v
+	}
+
+	if err := startCapture(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "started capture to %s\n", config.path)
+}
+
+func captureStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := stopCapture(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "stopped capture")
+}
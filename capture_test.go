@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCaptureStartHandlerRejectsInvalidRotation checks that the rotation parameters which would
+// rotate on every frame or keep no files are rejected before the capture starts
+func TestCaptureStartHandlerRejectsInvalidRotation(t *testing.T) {
+	saved := captureDir
+	captureDir = t.TempDir()
+	t.Cleanup(func() {
+		captureDir = saved
+	})
+
+	for _, query := range []string{
+		"size=0",
+		"size=-1",
+		"size=large",
+		"files=0",
+		"files=-5",
+		"files=many",
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/capture/start?file=test.pcapng&"+query, nil)
+		w := httptest.NewRecorder()
+		captureStartHandler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+		if c := activeCapture.Load(); c != nil {
+			t.Fatalf("%s: capture started", query)
+		}
+	}
+}
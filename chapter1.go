@@ -68,6 +68,7 @@ func runChapter1() {
 			macaddr:  setMacAddr(netif.HardwareAddr),
 			socket:   sock,
 			sockaddr: addr,
+			mtu:      netif.MTU,
 		})
 	}
 
@@ -78,7 +79,8 @@ func runChapter1() {
 			log.Fatalf("failed to EpollWait: %v", err)
 		}
 		for i := 0; i < nfds; i++ {
-			for _, netdev := range netDeviceList {
+			for j := range netDeviceList {
+				netdev := &netDeviceList[j]
 				if events[i].Fd != int32(netdev.socket) {
 					continue
 				}
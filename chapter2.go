@@ -3,23 +3,87 @@ package main
 import (
 	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
 var netDeviceList []*netDevice
-var iproute radixTreeNode
 
-func runChapter2() {
+// iproute is the snapshot of the routing table. The workers route by the snapshot
+// loaded at the time and the writers publish an updated copy under iprouteMu.
+var iproute atomic.Pointer[radixTreeNode]
+var iprouteMu sync.Mutex
+
+func init() {
+	iproute.Store(&radixTreeNode{})
+}
+
+// ipRouteAdd adds the route to a copy of the routing table and publishes the copy
+func ipRouteAdd(prefixIpAddr, prefixLen uint32, entry ipRouteEntry) {
+	iprouteMu.Lock()
+	defer iprouteMu.Unlock()
+	table := iproute.Load().clone(nil)
+	table.radixTreeAdd(prefixIpAddr, prefixLen, entry)
+	iproute.Store(table)
+}
+
+// ipRouteDelete removes the route from a copy of the routing table and publishes the copy
+func ipRouteDelete(prefixIpAddr, prefixLen uint32) {
+	iprouteMu.Lock()
+	defer iprouteMu.Unlock()
+	table := iproute.Load().clone(nil)
+	table.radixTreeDelete(prefixIpAddr, prefixLen)
+	iproute.Store(table)
+}
+
+// addStaticRoutes registers the static routes of the lab network
+func addStaticRoutes() {
 	// register route to host2
 	routeEntryToHost2 := ipRouteEntry{
 		iptype:  IpRouteTypeNetwork,
 		nexthop: 0xc0a80002,
 	}
 	// register entry route to 192.168.2.0/24
-	iproute.radixTreeAdd(0xc0a80202&0xffffff00, 24, routeEntryToHost2)
+	ipRouteAdd(0xc0a80202&0xffffff00, 24, routeEntryToHost2)
+}
 
-	// create epoll
-	events := make([]syscall.EpollEvent, 10)
+// addConnectedRoute registers the route to the network netdev is connected to
+func addConnectedRoute(netdev *netDevice) {
+	routeEntry := ipRouteEntry{
+		iptype: IpRouteTypeConnected,
+		netdev: netdev,
+	}
+	ipdev := netdev.ipdev()
+	prefixLen := subnetToPrefixLen(ipdev.netmask)
+	prefixIpAddr := uint32(ipdev.address) & ipdev.netmask
+	ipRouteAdd(prefixIpAddr, prefixLen, routeEntry)
+	log.Printf("Set directly connected route %s (%d via %s)",
+		printIPAddr(prefixIpAddr), prefixLen, netdev.name,
+	)
+}
+
+// removeConnectedRoute removes the route to the network netdev is connected to
+// when the route is still via netdev
+func removeConnectedRoute(netdev *netDevice) {
+	ipdev := netdev.ipdev()
+	prefixLen := subnetToPrefixLen(ipdev.netmask)
+	prefixIpAddr := uint32(ipdev.address) & ipdev.netmask
+	route := iproute.Load().radixTreeSearch(prefixIpAddr)
+	if route.iptype != IpRouteTypeConnected || route.netdev != netdev {
+		return
+	}
+	ipRouteDelete(prefixIpAddr, prefixLen)
+	log.Printf("Removed directly connected route %s (%d via %s)",
+		printIPAddr(prefixIpAddr), prefixLen, netdev.name,
+	)
+}
+
+func runChapter2() {
+	addStaticRoutes()
+
+	// create epoll of worker 0
 	epfd, err := syscall.EpollCreate1(0)
 	if err != nil {
 		log.Fatalf("epoll create err: %v", err)
@@ -36,19 +100,15 @@ func runChapter2() {
 			continue
 		}
 
-		// open socket
-		sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+		// open socket bound to the interface
+		sock, addr, err := newPacketSocket(netif.Index)
 		if err != nil {
-			log.Fatalf("failed to create socket: %v", err)
+			log.Fatalf("%v", err)
 		}
 
-		// bind the interface to the socket
-		addr := syscall.SockaddrLinklayer{
-			Protocol: htons(syscall.ETH_P_ALL),
-			Ifindex:  netif.Index,
-		}
-		if err := syscall.Bind(sock, &addr); err != nil {
-			log.Fatalf("failed to bind the interface to the socket: %v", err)
+		// the frames to the multicast groups, e.g. IGMP with router alert, are not filtered by the NIC
+		if err := joinAllMulticast(sock, netif.Index); err != nil {
+			log.Printf("%v on %s", err, netif.Name)
 		}
 
 		log.Printf("Created device %s socket %d address %s",
@@ -79,38 +139,73 @@ func runChapter2() {
 			macaddr:  setMacAddr(netif.HardwareAddr),
 			socket:   sock,
 			sockaddr: addr,
-			ipdev:    *ipdev,
+			mtu:      netif.MTU,
 		}
+		netdev.setAddress(*ipdev)
 
-		routeEntry := ipRouteEntry{
-			iptype: IpRouteTypeConnected,
-			netdev: &netdev,
-		}
-		prefixLen := subnetToPrefixLen(netdev.ipdev.netmask)
-		prefixIpAddr := uint32(netdev.ipdev.address) & netdev.ipdev.netmask
-		iproute.radixTreeAdd(prefixIpAddr, prefixLen, routeEntry)
-		log.Printf("Set directly connected route %s (%d via %s)",
-			printIPAddr(prefixIpAddr), prefixLen, netdev.name,
-		)
+		addConnectedRoute(&netdev)
 
 		netDeviceList = append(netDeviceList, &netdev)
 	}
 
-	for {
-		nfds, err := syscall.EpollWait(epfd, events, -1)
-		if err != nil {
-			log.Fatalf("failed to EpollWait: %v", err)
-		}
-		for i := 0; i < nfds; i++ {
-
-			for _, netdev := range netDeviceList {
-				if events[i].Fd != int32(netdev.socket) {
-					continue
-				}
-				if err := netdev.netDevicePoll("ch2"); err != nil {
-					log.Fatalf("failed to net device poll: %v", err)
-				}
-			}
+	if err := setupMTU(); err != nil {
+		log.Fatalf("failed to set up MTU: %v", err)
+	}
+	setupPacketRings()
+	if err := setupXDP(epfd); err != nil {
+		log.Fatalf("failed to set up AF_XDP: %v", err)
+	}
+	setupPacketQueues()
+	if err := setupAddressWatch(epfd); err != nil {
+		log.Fatalf("failed to watch address changes: %v", err)
+	}
+	if err := setupMirrorSessions(); err != nil {
+		log.Fatalf("failed to set up mirror sessions: %v", err)
+	}
+	if err := setupAccessLists(); err != nil {
+		log.Fatalf("failed to set up access lists: %v", err)
+	}
+	if err := setupFirewall(); err != nil {
+		log.Fatalf("failed to set up firewall: %v", err)
+	}
+	if err := setupURPF(); err != nil {
+		log.Fatalf("failed to set up uRPF: %v", err)
+	}
+	if err := setupArpInspection(); err != nil {
+		log.Fatalf("failed to set up ARP inspection: %v", err)
+	}
+	if err := setupProxyArp(); err != nil {
+		log.Fatalf("failed to set up proxy ARP: %v", err)
+	}
+
+	if metricsListenAddr != "" {
+		startMetricsServer(metricsListenAddr)
+	}
+
+	if captureOptions.path != "" {
+		if err := startCapture(captureOptions); err != nil {
+			log.Fatalf("failed to start capture: %v", err)
 		}
 	}
+
+	// monitor SIGINT and SIGTERM by epoll
+	sigfd, err := watchShutdownSignal()
+	if err != nil {
+		log.Fatalf("failed to watch signals: %v", err)
+	}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, sigfd, &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(sigfd),
+	}); err != nil {
+		log.Fatalf("failed to epoll ctrl: %v", err)
+	}
+
+	stopping := runPacketWorkers("ch2", epfd, sigfd)
+
+	status := routerShutdown(epfd, sigfd)
+	if !stopping {
+		log.Printf("no network device is available")
+		status = 1
+	}
+	os.Exit(status)
 }
@@ -0,0 +1,66 @@
+package main
+
+import "encoding/binary"
+
+// Internet checksum (RFC 1071) and its incremental update (RFC 1624)
+
+// checksumAdd adds the 16-bit big endian words of b to sum.
+// The odd byte at the end is padded with zero.
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds the carries of sum into 16 bits and returns its one's complement
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// calcChecksum returns the checksum of b. The checksum of data including a valid checksum is 0.
+func calcChecksum(b []byte) uint16 {
+	return checksumFold(checksumAdd(0, b))
+}
+
+// checksumUpdate16 returns the checksum after a 16-bit field changes from old to new (RFC 1624 eqn. 3)
+func checksumUpdate16(checksum, old, new uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^old) + uint32(new)
+	return checksumFold(sum)
+}
+
+// checksumUpdate32 returns the checksum after a 32-bit field, e.g. an address, changes from old to new
+func checksumUpdate32(checksum uint16, old, new uint32) uint16 {
+	sum := uint32(^checksum) +
+		uint32(^uint16(old>>16)) + uint32(^uint16(old)) +
+		uint32(uint16(new>>16)) + uint32(uint16(new))
+	return checksumFold(sum)
+}
+
+// pseudoHeaderSum returns the sum of the IPv4 pseudo header of TCP and UDP
+func pseudoHeaderSum(srcAddr, destAddr IpAddress, protocol uint8, length int) uint32 {
+	return uint32(srcAddr>>16) + uint32(srcAddr&0xffff) +
+		uint32(destAddr>>16) + uint32(destAddr&0xffff) +
+		uint32(protocol) + uint32(length)
+}
+
+// transportChecksumValid verifies the checksum of the received TCP or UDP segment
+func transportChecksumValid(srcAddr, destAddr IpAddress, protocol uint8, segment []byte) bool {
+	if protocol == IpProtocolNumUDP && len(segment) >= 8 && binary.BigEndian.Uint16(segment[6:8]) == 0 {
+		// the sender did not compute the checksum
+		return true
+	}
+	return checksumFold(checksumAdd(pseudoHeaderSum(srcAddr, destAddr, protocol, len(segment)), segment)) == 0
+}
+
+// icmpChecksum returns the checksum of the ICMP message. ICMP has no pseudo header.
+func icmpChecksum(message []byte) uint16 {
+	return calcChecksum(message)
+}
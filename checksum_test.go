@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// referenceChecksum computes the RFC 1071 checksum byte by byte with a 64-bit accumulator
+func referenceChecksum(b []byte) uint16 {
+	var sum uint64
+	for i, c := range b {
+		if i%2 == 0 {
+			sum += uint64(c) << 8
+		} else {
+			sum += uint64(c)
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func FuzzCalcChecksum(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x01})
+	f.Add([]byte{0x45, 0x00, 0x00})
+	f.Add(bytes.Repeat([]byte{0xff}, 2))
+	f.Add(bytes.Repeat([]byte{0xff}, 7))
+	f.Add(bytes.Repeat([]byte{0xff}, 1500))
+	f.Add(make([]byte, 21))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checksum := calcChecksum(b)
+		if want := referenceChecksum(b); checksum != want {
+			t.Fatalf("calcChecksum(% x) = %#04x, want %#04x", b, checksum, want)
+		}
+
+		// the data followed by its checksum at an even offset sums to zero
+		padded := append([]byte{}, b...)
+		if len(padded)%2 != 0 {
+			padded = append(padded, 0)
+		}
+		padded = binary.BigEndian.AppendUint16(padded, checksum)
+		if got := calcChecksum(padded); got != 0 {
+			t.Fatalf("checksum of % x with its checksum = %#04x, want 0", b, got)
+		}
+	})
+}
+
+// FuzzChecksumUpdate checks that the incremental updates match the recomputation
+// after a 16-bit and a 32-bit field of an IPv4 header change
+func FuzzChecksumUpdate(f *testing.F) {
+	f.Add(bytes.Repeat([]byte{0xff}, 20), uint8(4), uint16(0), uint8(12), uint32(0))
+	f.Add(make([]byte, 20), uint8(8), uint16(0xffff), uint8(16), uint32(0xffffffff))
+	f.Add([]byte{0x45, 0x00, 0x00, 0x54, 0x12, 0x34, 0x40, 0x00, 0x40, 0x01}, uint8(8), uint16(0x3f01), uint8(12), uint32(0xc0a80001))
+
+	f.Fuzz(func(t *testing.T, b []byte, off16 uint8, new16 uint16, off32 uint8, new32 uint32) {
+		header := make([]byte, IP_HEADER_LEN)
+		copy(header, b)
+		// the checksum field and the changed fields are 16-bit aligned and do not overlap it
+		off16 = off16 % 10 * 2
+		off32 = off32 % 9 * 2
+		if off16 == 10 || off32 == 8 || off32 == 10 {
+			return
+		}
+		header[0] = 0x45
+		ipv4View(header).updateChecksum()
+
+		old16 := binary.BigEndian.Uint16(header[off16:])
+		binary.BigEndian.PutUint16(header[off16:], new16)
+		if allZeroExceptChecksum(header) {
+			// the recomputation gives 0xffff and the update the equivalent 0x0000 (RFC 1624 section 3),
+			// which cannot happen to an IPv4 header whose version is 4
+			return
+		}
+		updated := checksumUpdate16(ipv4View(header).headerChecksum(), old16, new16)
+		binary.BigEndian.PutUint16(header[10:12], updated)
+		if got := calcChecksum(header); got != 0 {
+			t.Fatalf("checksumUpdate16 at %d from %#04x to %#04x: header % x sums to %#04x", off16, old16, new16, header, got)
+		}
+
+		old32 := binary.BigEndian.Uint32(header[off32:])
+		binary.BigEndian.PutUint32(header[off32:], new32)
+		if allZeroExceptChecksum(header) {
+			return
+		}
+		updated = checksumUpdate32(ipv4View(header).headerChecksum(), old32, new32)
+		binary.BigEndian.PutUint16(header[10:12], updated)
+		if got := calcChecksum(header); got != 0 {
+			t.Fatalf("checksumUpdate32 at %d from %#08x to %#08x: header % x sums to %#04x", off32, old32, new32, header, got)
+		}
+	})
+}
+
+func allZeroExceptChecksum(header []byte) bool {
+	for i, c := range header {
+		if i != 10 && i != 11 && c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTransportChecksumValid(t *testing.T) {
+	src, dst := IpAddress(0xc0a80102), IpAddress(0xc0a80001)
+	udp := []byte{0x30, 0x39, 0x00, 0x35, 0x00, 0x0b, 0x00, 0x00, 'a', 'b', 'c'}
+	sum := pseudoHeaderSum(src, dst, IpProtocolNumUDP, len(udp))
+	binary.BigEndian.PutUint16(udp[6:8], checksumFold(checksumAdd(sum, udp)))
+
+	if !transportChecksumValid(src, dst, IpProtocolNumUDP, udp) {
+		t.Error("valid UDP checksum is rejected")
+	}
+	if transportChecksumValid(src, dst+1, IpProtocolNumUDP, udp) {
+		t.Error("UDP checksum with another destination is accepted")
+	}
+	udp[8] ^= 0xff
+	if transportChecksumValid(src, dst, IpProtocolNumUDP, udp) {
+		t.Error("corrupted UDP segment is accepted")
+	}
+	binary.BigEndian.PutUint16(udp[6:8], 0)
+	if !transportChecksumValid(src, dst, IpProtocolNumUDP, udp) {
+		t.Error("UDP segment without checksum is rejected")
+	}
+	if transportChecksumValid(src, dst, IpProtocolNumTCP, make([]byte, 20)) {
+		t.Error("TCP segment with zero checksum is accepted")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+// The tests exercise the state shared by the packet workers from several goroutines.
+// They are meant to be run with the race detector: go test -race
+
+const concurrencyTestWorkers = 4
+
+// concurrencyTestPrefix returns the prefix 10.99.i.0/24 of the routes added by the tests
+func concurrencyTestPrefix(i uint32) uint32 {
+	return 0x0a630000 | i<<8
+}
+
+// useEmptyRoutes starts the test with an empty routing table and restores the table after it
+func useEmptyRoutes(tb testing.TB) {
+	saved := iproute.Load()
+	iproute.Store(&radixTreeNode{})
+	tb.Cleanup(func() {
+		iproute.Store(saved)
+	})
+}
+
+// removeArpTableEntries removes the entries of the addresses from the ARP cache
+func removeArpTableEntries(addrs []IpAddress) {
+	for _, addr := range addrs {
+		shard := arpCacheShardOf(addr)
+		shard.mu.Lock()
+		if _, ok := shard.entries[addr]; ok {
+			delete(shard.entries, addr)
+			metricArpCacheEntries.dec()
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// TestConcurrentRouteUpdate checks that the lookups see either no route or the complete entry
+// while the routes are added and deleted
+func TestConcurrentRouteUpdate(t *testing.T) {
+	useEmptyRoutes(t)
+	const routes = 256
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < concurrencyTestWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				prefix := concurrencyTestPrefix(i % routes)
+				route := iproute.Load().radixTreeSearch(prefix | 1)
+				if route != (ipRouteEntry{}) && route.nexthop != prefix|0xfe {
+					t.Errorf("route of %s has next hop %s", IpAddress(prefix|1), IpAddress(route.nexthop))
+					return
+				}
+			}
+		}()
+	}
+
+	for i := uint32(0); i < routes; i++ {
+		prefix := concurrencyTestPrefix(i)
+		ipRouteAdd(prefix, 24, ipRouteEntry{iptype: IpRouteTypeNetwork, nexthop: prefix | 0xfe})
+	}
+	for i := uint32(0); i < routes; i += 2 {
+		ipRouteDelete(concurrencyTestPrefix(i), 24)
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := uint32(0); i < routes; i++ {
+		prefix := concurrencyTestPrefix(i)
+		route := iproute.Load().radixTreeSearch(prefix | 1)
+		if deleted := i%2 == 0; deleted != (route == ipRouteEntry{}) {
+			t.Errorf("route of %s = %+v after the updates (deleted %t)", IpAddress(prefix|1), route, deleted)
+		}
+	}
+}
+
+// TestConcurrentArpTableAccess checks that the entries updated and looked up by several
+// goroutines across all the shards are never seen partially written
+func TestConcurrentArpTableAccess(t *testing.T) {
+	var addrs []IpAddress
+	for i := 0; i < 4*arpCacheShards; i++ {
+		addrs = append(addrs, IpAddress(concurrencyTestPrefix(0)|uint32(i)))
+	}
+	t.Cleanup(func() {
+		removeArpTableEntries(addrs)
+	})
+	macAddrOf := func(addr IpAddress, round int) [6]uint8 {
+		return [6]uint8{0x02, uint8(round), uint8(addr >> 8), uint8(addr), uint8(round), uint8(addr)}
+	}
+	consistent := func(entry arpTableEntry) bool {
+		mac := entry.macAddr
+		return mac[1] == mac[4] && mac[3] == uint8(entry.ipAddr) && mac[5] == uint8(entry.ipAddr)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrencyTestWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < 100; round++ {
+				for _, addr := range addrs {
+					updateArpTableEntry(addr, func(entry *arpTableEntry, exists bool) bool {
+						entry.macAddr = macAddrOf(addr, w*100+round)
+						return true
+					})
+					if entry, ok := lookupArpTableEntry(addr); !ok || !consistent(entry) {
+						t.Errorf("entry of %s = %+v", addr, entry)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// setupConcurrencyTestDevices sets up the virtual devices race-r1 on 10.99.1.0/24 and race-r2 on
+// 10.99.2.0/24 with their connected routes and forwarding enabled, restoring the state after the test
+func setupConcurrencyTestDevices(tb testing.TB) (*netDevice, *netDevice) {
+	useEmptyRoutes(tb)
+	savedDevices, savedForwarding := netDeviceList, ipForwarding
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() {
+		netDeviceList, ipForwarding = savedDevices, savedForwarding
+		log.SetOutput(os.Stderr)
+	})
+
+	r1, err := parseReplayDevice("race-r1=02:00:00:00:01:01,10.99.1.1/24")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r2, err := parseReplayDevice("race-r2=02:00:00:00:02:01,10.99.2.1/24")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	netDeviceList = []*netDevice{r1, r2}
+	ipForwarding = true
+	addConnectedRoute(r1)
+	addConnectedRoute(r2)
+	return r1, r2
+}
+
+// concurrencyTestPacket returns the IP packet of the protocol from 10.99.1.2 to destAddr
+func concurrencyTestPacket(destAddr IpAddress, protocol uint8, payload []byte) []byte {
+	b := make([]byte, IP_HEADER_LEN+len(payload))
+	ipHeader{
+		version:   4,
+		headerLen: IP_HEADER_LEN / 4,
+		totalLen:  uint16(IP_HEADER_LEN + len(payload)),
+		ttl:       64,
+		protocol:  protocol,
+		srcAddr:   0x0a630102,
+		destAddr:  destAddr,
+	}.encode(b)
+	ipv4View(b).updateChecksum()
+	copy(b[IP_HEADER_LEN:], payload)
+	return b
+}
+
+// TestConcurrentNetDeviceReceive processes the frames received on a virtual device by several
+// goroutines as the fanout workers do, forwarding UDP to another device and answering echo requests
+func TestConcurrentNetDeviceReceive(t *testing.T) {
+	r1, r2 := setupConcurrencyTestDevices(t)
+
+	host1, host2 := IpAddress(0x0a630102), IpAddress(0x0a630202)
+	host1Mac := [6]uint8{0x02, 0x00, 0x00, 0x00, 0x01, 0x02}
+	addArpTableEntry(r1, host1, host1Mac, true)
+	addArpTableEntry(r2, host2, [6]uint8{0x02, 0x00, 0x00, 0x00, 0x02, 0x02}, true)
+	t.Cleanup(func() {
+		removeArpTableEntries([]IpAddress{host1, host2})
+	})
+
+	frame := func(packet []byte) []byte {
+		b := make([]byte, ETHERNET_HEADER_LEN+len(packet))
+		ethernetHeader{destAddr: r1.macaddr, srcAddr: host1Mac, etherType: ETHER_TYPE_IP}.encode(b)
+		copy(b[ETHERNET_HEADER_LEN:], packet)
+		return b
+	}
+	// UDP without checksum from host1 to host2
+	udp := frame(concurrencyTestPacket(host2, IpProtocolNumUDP, []byte{0x30, 0x39, 0x13, 0x88, 0x00, 0x0c, 0x00, 0x00, 'p', 'i', 'n', 'g'}))
+	echo := []byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0, 0x12, 0x34, 0x00, 0x01, 'p', 'i', 'n', 'g'}
+	copy(echo[2:4], uint16ToBytes(icmpChecksum(echo)))
+	echoRequest := frame(concurrencyTestPacket(r1.ipdev().address, IpProtocolNumICMP, echo))
+
+	// the echo requests stay within the burst of the CoPP policer of ICMP
+	const udpFrames, echoFrames = 200, 20
+	var wg sync.WaitGroup
+	for w := 0; w < concurrencyTestWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < udpFrames+echoFrames; i++ {
+				data := udp
+				if i%(udpFrames/echoFrames+1) == 0 {
+					data = echoRequest
+				}
+				pb := getPacketBuffer(packetBufferHeadroom, len(data))
+				copy(pb.append(len(data)), data)
+				err := r1.netDeviceReceive("ch2", pb, len(data))
+				pb.free()
+				if err != nil {
+					t.Errorf("failed to receive: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := r1.stats.rxPackets.Load(), uint64(concurrencyTestWorkers*(udpFrames+echoFrames)); got != want {
+		t.Errorf("received %d frames on %s, want %d", got, r1.name, want)
+	}
+	if got := r1.stats.rxDropped.Load(); got != 0 {
+		t.Errorf("dropped %d frames on %s", got, r1.name)
+	}
+	if got, want := r2.stats.txPackets.Load(), uint64(concurrencyTestWorkers*udpFrames); got != want {
+		t.Errorf("forwarded %d frames via %s, want %d", got, r2.name, want)
+	}
+	if got, want := r1.stats.txPackets.Load(), uint64(concurrencyTestWorkers*echoFrames); got != want {
+		t.Errorf("sent %d echo replies via %s, want %d", got, r1.name, want)
+	}
+}
+
+// BenchmarkIPForwardParallel forwards packets to 128 hosts, spread over the shards of the ARP cache,
+// from every goroutine of RunParallel. Compare the results of -cpu 1,2,4,... to see how forwarding
+// scales with the cores sharing the route snapshot and the ARP cache.
+func BenchmarkIPForwardParallel(b *testing.B) {
+	r1, r2 := setupConcurrencyTestDevices(b)
+	ethHeader := ethernetHeader{
+		destAddr:  r1.macaddr,
+		srcAddr:   [6]uint8{0x02, 0x00, 0x00, 0x00, 0x01, 0x02},
+		etherType: ETHER_TYPE_IP,
+	}
+
+	var hosts []IpAddress
+	var packets [][]byte
+	for i := 0; i < 128; i++ {
+		host := IpAddress(concurrencyTestPrefix(2) | uint32(i+2))
+		hosts = append(hosts, host)
+		addArpTableEntry(r2, host, [6]uint8{0x02, 0x00, 0x00, 0x00, 0x02, uint8(i + 2)}, true)
+		packets = append(packets, concurrencyTestPacket(host, IpProtocolNumUDP, make([]byte, 8+64)))
+	}
+	b.Cleanup(func() {
+		removeArpTableEntries(hosts)
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for i := 0; p.Next(); i++ {
+			packet := packets[i%len(packets)]
+			pb := getPacketBuffer(ETHERNET_HEADER_LEN, len(packet))
+			copy(pb.append(len(packet)), packet)
+			ipheader := parseIPHeader(packet)
+			err := ipForward(r1, ethHeader, &ipheader, pb)
+			pb.free()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
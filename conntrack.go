@@ -0,0 +1,416 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// firewallOutsideInterfaces are the interfaces new connections cannot be initiated from.
+// Setting them enables the connection tracking.
+var firewallOutsideInterfaces []string
+
+// conntrackMaxEntries bounds the connection tracking table
+var conntrackMaxEntries = 65536
+
+const (
+	TCP_FLAG_FIN uint8 = 0x01
+	TCP_FLAG_SYN uint8 = 0x02
+	TCP_FLAG_RST uint8 = 0x04
+	TCP_FLAG_ACK uint8 = 0x10
+)
+
+type conntrackState uint8
+
+const (
+	// UDP and ICMP
+	conntrackStateNew conntrackState = iota
+	conntrackStateReplied
+	// TCP
+	conntrackStateSynSent
+	conntrackStateSynRecv
+	conntrackStateEstablished
+	conntrackStateFinWait
+	conntrackStateCloseWait
+	conntrackStateLastAck
+	conntrackStateTimeWait
+	conntrackStateClose
+)
+
+var conntrackStateNames = map[conntrackState]string{
+	conntrackStateNew:         "NEW",
+	conntrackStateReplied:     "REPLIED",
+	conntrackStateSynSent:     "SYN_SENT",
+	conntrackStateSynRecv:     "SYN_RECV",
+	conntrackStateEstablished: "ESTABLISHED",
+	conntrackStateFinWait:     "FIN_WAIT",
+	conntrackStateCloseWait:   "CLOSE_WAIT",
+	conntrackStateLastAck:     "LAST_ACK",
+	conntrackStateTimeWait:    "TIME_WAIT",
+	conntrackStateClose:       "CLOSE",
+}
+
+func (state conntrackState) String() string {
+	return conntrackStateNames[state]
+}
+
+// timeout returns how long the entry in the state lives without packets
+func (state conntrackState) timeout(protocol uint8) time.Duration {
+	switch protocol {
+	case IpProtocolNumTCP:
+		switch state {
+		case conntrackStateSynSent, conntrackStateFinWait, conntrackStateTimeWait:
+			return 120 * time.Second
+		case conntrackStateSynRecv, conntrackStateCloseWait:
+			return 60 * time.Second
+		case conntrackStateEstablished:
+			return 5 * 24 * time.Hour
+		case conntrackStateLastAck:
+			return 30 * time.Second
+		default:
+			return 10 * time.Second
+		}
+	case IpProtocolNumUDP:
+		if state == conntrackStateReplied {
+			return 180 * time.Second
+		}
+		return 30 * time.Second
+	default:
+		return 30 * time.Second
+	}
+}
+
+type conntrackDirection uint8
+
+const (
+	conntrackDirectionOriginal conntrackDirection = iota
+	conntrackDirectionReply
+)
+
+// conntrackVerdict is the relation of a packet to the tracked connections
+type conntrackVerdict uint8
+
+const (
+	conntrackVerdictNew conntrackVerdict = iota
+	conntrackVerdictEstablished
+	conntrackVerdictRelated
+	// the packet cannot start a connection, e.g. TCP without SYN
+	conntrackVerdictInvalid
+	// the packet is not tracked, e.g. a non-first fragment
+	conntrackVerdictUntracked
+)
+
+type conntrackEntry struct {
+	original flowKey
+	reply    flowKey
+	state    conntrackState
+	// the direction of the first FIN
+	finDirection conntrackDirection
+	expires      time.Time
+	packets      [2]uint64
+	elem         *list.Element
+	// the position in conntrackTable.expiry
+	index int
+}
+
+// conntrackExpiry is a min-heap of the entries ordered by the expiry time.
+// The timeouts differ per state, so the least recently used entry is not always the first to expire.
+type conntrackExpiry []*conntrackEntry
+
+func (h conntrackExpiry) Len() int           { return len(h) }
+func (h conntrackExpiry) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h conntrackExpiry) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *conntrackExpiry) Push(x any) {
+	entry := x.(*conntrackEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *conntrackExpiry) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// conntrackTable holds the connections in least recently used order
+// and in the order of the expiry
+type conntrackTable struct {
+	mu      sync.Mutex
+	entries map[flowKey]*conntrackEntry
+	lru     *list.List
+	expiry  conntrackExpiry
+	max     int
+}
+
+var conntrack *conntrackTable
+
+var (
+	metricConntrackEntries = newGauge(
+		"curo_conntrack_entries",
+		"Number of tracked connections.",
+	)
+	metricConntrackEvictions = newCounterVec(
+		"curo_conntrack_evictions_total",
+		"Number of connections evicted from the full table.",
+	)
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricConntrackEntries, metricConntrackEvictions)
+	registerHTTPHandler("/conntrack", conntrackHandler)
+	registerTimerHook(conntrackExpire)
+}
+
+func newConntrackTable(max int) *conntrackTable {
+	return &conntrackTable{
+		entries: make(map[flowKey]*conntrackEntry),
+		lru:     list.New(),
+		max:     max,
+	}
+}
+
+// setupFirewall enables the connection tracking when the outside interfaces are set
+func setupFirewall() error {
+	if len(firewallOutsideInterfaces) == 0 {
+		return nil
+	}
+	for _, name := range firewallOutsideInterfaces {
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("outside device %s is not found", name)
+		}
+		netdev.firewallOutside = true
+		log.Printf("Set %s as firewall outside", name)
+	}
+	conntrack = newConntrackTable(conntrackMaxEntries)
+	return nil
+}
+
+// track updates the connection of the packet.
+// A new connection is created only when create is true.
+func (t *conntrackTable) track(info *packetInfo, create bool) conntrackVerdict {
+	now := clock.Now()
+
+	key, ok := flowKeyFromPacket(info)
+	if !ok {
+		if inner, ok := icmpErrorInnerFlowKey(info); ok {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.lookup(inner, now) != nil {
+				return conntrackVerdictRelated
+			}
+			return conntrackVerdictInvalid
+		}
+		return conntrackVerdictUntracked
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry := t.lookup(key, now); entry != nil {
+		dir := conntrackDirectionOriginal
+		if key == entry.reply {
+			dir = conntrackDirectionReply
+		}
+		entry.update(info, dir)
+		entry.packets[dir]++
+		entry.expires = now.Add(entry.state.timeout(key.protocol))
+		heap.Fix(&t.expiry, entry.index)
+		t.lru.MoveToBack(entry.elem)
+		return conntrackVerdictEstablished
+	}
+
+	if key.protocol == IpProtocolNumTCP && info.tcpFlags&(TCP_FLAG_SYN|TCP_FLAG_ACK|TCP_FLAG_RST) != TCP_FLAG_SYN {
+		return conntrackVerdictInvalid
+	}
+	if key.protocol == IpProtocolNumICMP && info.icmpType != ICMP_TYPE_ECHO_REQUEST && info.icmpType != ICMP_TYPE_TIMESTAMP {
+		return conntrackVerdictInvalid
+	}
+	if !create {
+		return conntrackVerdictNew
+	}
+
+	entry := &conntrackEntry{
+		original: key,
+		reply:    key.reverse(),
+		state:    conntrackStateNew,
+	}
+	if key.protocol == IpProtocolNumTCP {
+		entry.state = conntrackStateSynSent
+	}
+	entry.packets[conntrackDirectionOriginal] = 1
+	entry.expires = now.Add(entry.state.timeout(key.protocol))
+	t.insert(entry, now)
+	return conntrackVerdictNew
+}
+
+// lookup returns the live entry of the key, removing it if expired
+func (t *conntrackTable) lookup(key flowKey, now time.Time) *conntrackEntry {
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(entry.expires) {
+		t.remove(entry)
+		return nil
+	}
+	return entry
+}
+
+// insert adds the entry. When the table is full after removing the expired entries,
+// the least recently used live entry is evicted.
+func (t *conntrackTable) insert(entry *conntrackEntry, now time.Time) {
+	t.purge(now)
+	if t.max > 0 && t.lru.Len() >= t.max {
+		t.remove(t.lru.Front().Value.(*conntrackEntry))
+		metricConntrackEvictions.inc()
+	}
+
+	entry.elem = t.lru.PushBack(entry)
+	heap.Push(&t.expiry, entry)
+	t.entries[entry.original] = entry
+	t.entries[entry.reply] = entry
+	metricConntrackEntries.set(t.lru.Len())
+}
+
+// conntrackExpire removes the expired connections periodically
+func conntrackExpire(now time.Time) {
+	if conntrack == nil {
+		return
+	}
+	conntrack.mu.Lock()
+	defer conntrack.mu.Unlock()
+	conntrack.purge(now)
+}
+
+// purge removes the expired entries
+func (t *conntrackTable) purge(now time.Time) {
+	for len(t.expiry) > 0 && !now.Before(t.expiry[0].expires) {
+		t.remove(t.expiry[0])
+	}
+}
+
+func (t *conntrackTable) remove(entry *conntrackEntry) {
+	t.lru.Remove(entry.elem)
+	heap.Remove(&t.expiry, entry.index)
+	delete(t.entries, entry.original)
+	delete(t.entries, entry.reply)
+	metricConntrackEntries.set(t.lru.Len())
+}
+
+// update advances the state by the packet in the direction
+func (entry *conntrackEntry) update(info *packetInfo, dir conntrackDirection) {
+	if entry.original.protocol != IpProtocolNumTCP {
+		if dir == conntrackDirectionReply {
+			entry.state = conntrackStateReplied
+		}
+		return
+	}
+
+	flags := info.tcpFlags
+	if flags&TCP_FLAG_RST != 0 {
+		entry.state = conntrackStateClose
+		return
+	}
+	switch entry.state {
+	case conntrackStateSynSent:
+		if dir == conntrackDirectionReply && flags&(TCP_FLAG_SYN|TCP_FLAG_ACK) == TCP_FLAG_SYN|TCP_FLAG_ACK {
+			entry.state = conntrackStateSynRecv
+		}
+	case conntrackStateSynRecv:
+		if dir == conntrackDirectionOriginal && flags&(TCP_FLAG_SYN|TCP_FLAG_ACK) == TCP_FLAG_ACK {
+			entry.state = conntrackStateEstablished
+		}
+	case conntrackStateEstablished:
+		if flags&TCP_FLAG_FIN != 0 {
+			entry.state = conntrackStateFinWait
+			entry.finDirection = dir
+		}
+	case conntrackStateFinWait:
+		if dir != entry.finDirection {
+			if flags&TCP_FLAG_FIN != 0 {
+				entry.state = conntrackStateLastAck
+			} else if flags&TCP_FLAG_ACK != 0 {
+				entry.state = conntrackStateCloseWait
+			}
+		}
+	case conntrackStateCloseWait:
+		if dir != entry.finDirection && flags&TCP_FLAG_FIN != 0 {
+			entry.state = conntrackStateLastAck
+		}
+	case conntrackStateLastAck:
+		if dir == entry.finDirection && flags&TCP_FLAG_ACK != 0 {
+			entry.state = conntrackStateTimeWait
+		}
+	}
+}
+
+// firewallCheckIngress tracks the packet received on inputdev and
+// returns false when it initiates a new connection from the outside
+func firewallCheckIngress(inputdev *netDevice, packet []byte) bool {
+	if conntrack == nil {
+		return true
+	}
+
+	var info packetInfo
+	info.parseIP(packet)
+	verdict := conntrack.track(&info, !inputdev.firewallOutside)
+	if !inputdev.firewallOutside {
+		return true
+	}
+	switch verdict {
+	case conntrackVerdictEstablished, conntrackVerdictRelated:
+		return true
+	case conntrackVerdictUntracked:
+		// fragments without the upper layer header cannot be checked
+		if info.ip.fragmentOffset&0x1fff != 0 {
+			return true
+		}
+	}
+	dropPacket(inputdev, dropReasonFirewallDenied, packet)
+	return false
+}
+
+// firewallTrackEgress tracks the packet sent by the router
+func firewallTrackEgress(packet []byte) {
+	if conntrack == nil {
+		return
+	}
+
+	var info packetInfo
+	info.parseIP(packet)
+	conntrack.track(&info, true)
+}
+
+// conntrackHandler dumps the tracked connections
+func conntrackHandler(w http.ResponseWriter, _ *http.Request) {
+	if conntrack == nil {
+		fmt.Fprintln(w, "connection tracking is disabled")
+		return
+	}
+
+	now := clock.Now()
+	conntrack.mu.Lock()
+	defer conntrack.mu.Unlock()
+	for elem := conntrack.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*conntrackEntry)
+		fmt.Fprintf(w, "%s %s expires=%ds packets=%d [reply] src=%s dst=%s sport=%d dport=%d packets=%d\n",
+			entry.state, entry.original,
+			int(entry.expires.Sub(now).Seconds()),
+			entry.packets[conntrackDirectionOriginal],
+			entry.reply.srcAddr, entry.reply.dstAddr, entry.reply.srcPort, entry.reply.dstPort,
+			entry.packets[conntrackDirectionReply],
+		)
+	}
+}
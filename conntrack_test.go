@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testConntrackEntry(port uint16, protocol uint8, state conntrackState, expires time.Time) *conntrackEntry {
+	key := flowKey{
+		srcAddr:  0x0a000001,
+		dstAddr:  0x0a000102,
+		srcPort:  port,
+		dstPort:  53,
+		protocol: protocol,
+	}
+	return &conntrackEntry{original: key, reply: key.reverse(), state: state, expires: expires}
+}
+
+// TestConntrackInsertPurgesExpired checks that the expired entries are removed even when a live
+// entry with a longer timeout is least recently used, and that no live entry is evicted for them
+func TestConntrackInsertPurgesExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	table := newConntrackTable(3)
+
+	established := testConntrackEntry(1, IpProtocolNumTCP, conntrackStateEstablished, now.Add(5*24*time.Hour))
+	table.insert(established, now)
+	table.insert(testConntrackEntry(2, IpProtocolNumUDP, conntrackStateNew, now.Add(30*time.Second)), now)
+	table.insert(testConntrackEntry(3, IpProtocolNumUDP, conntrackStateNew, now.Add(30*time.Second)), now)
+
+	later := now.Add(time.Minute)
+	fresh := testConntrackEntry(4, IpProtocolNumUDP, conntrackStateNew, later.Add(30*time.Second))
+	table.insert(fresh, later)
+
+	if got := table.lru.Len(); got != 2 {
+		t.Errorf("entries = %d, want 2", got)
+	}
+	if table.entries[established.original] != established {
+		t.Error("the live established entry was evicted")
+	}
+	if table.entries[fresh.original] != fresh {
+		t.Error("the inserted entry is missing")
+	}
+	if len(table.expiry) != table.lru.Len() {
+		t.Errorf("expiry heap has %d entries, want %d", len(table.expiry), table.lru.Len())
+	}
+}
+
+// TestConntrackInsertEvictsLeastRecentlyUsed checks that a full table of live entries
+// evicts the least recently used one
+func TestConntrackInsertEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	table := newConntrackTable(2)
+
+	first := testConntrackEntry(1, IpProtocolNumUDP, conntrackStateNew, now.Add(30*time.Second))
+	second := testConntrackEntry(2, IpProtocolNumUDP, conntrackStateNew, now.Add(30*time.Second))
+	table.insert(first, now)
+	table.insert(second, now)
+	table.insert(testConntrackEntry(3, IpProtocolNumUDP, conntrackStateNew, now.Add(30*time.Second)), now)
+
+	if _, ok := table.entries[first.original]; ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if table.entries[second.original] != second {
+		t.Error("a more recently used entry was evicted")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coppClass is the class of the packets destined to the router itself
+type coppClass uint8
+
+const (
+	coppClassARP coppClass = iota
+	coppClassICMP
+	// OSPF, RIP and BGP
+	coppClassRouting
+	// SSH, Telnet and SNMP
+	coppClassManagement
+	coppClassOther
+)
+
+var coppClassNames = map[coppClass]string{
+	coppClassARP:        "arp",
+	coppClassICMP:       "icmp",
+	coppClassRouting:    "routing",
+	coppClassManagement: "management",
+	coppClassOther:      "other",
+}
+
+func (class coppClass) String() string {
+	return coppClassNames[class]
+}
+
+const (
+	PORT_SSH    uint16 = 22
+	PORT_TELNET uint16 = 23
+	PORT_SNMP   uint16 = 161
+	PORT_BGP    uint16 = 179
+	PORT_RIP    uint16 = 520
+)
+
+// tokenBucket allows rate packets per second on average and burst packets at once
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// allow takes a token if available. A bucket with zero rate allows everything.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil || b.rate == 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// coppPolicers are the policers of each class, overridden by -copp
+var coppPolicers = map[coppClass]*tokenBucket{
+	coppClassARP:        newTokenBucket(100, 200),
+	coppClassICMP:       newTokenBucket(100, 200),
+	coppClassRouting:    newTokenBucket(1000, 2000),
+	coppClassManagement: newTokenBucket(500, 1000),
+	coppClassOther:      newTokenBucket(100, 200),
+}
+
+// icmpErrorLimiter bounds the ICMP error messages the router generates
+var icmpErrorLimiter = newTokenBucket(100, 50)
+
+var (
+	metricCoPPDrops = newCounterVec(
+		"curo_copp_drops_total",
+		"Number of packets to the router dropped by the control-plane policers.",
+		"class",
+	)
+	metricICMPErrorsRateLimited = newCounterVec(
+		"curo_icmp_errors_ratelimited_total",
+		"Number of ICMP error messages not sent due to the rate limit.",
+	)
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricCoPPDrops, metricICMPErrorsRateLimited)
+}
+
+// parseRateBurst parses RATE[/BURST] in packets per second. The burst defaults to the rate.
+func parseRateBurst(s string) (*tokenBucket, error) {
+	ratestr, burststr, hasBurst := strings.Cut(s, "/")
+	rate, err := strconv.ParseFloat(ratestr, 64)
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("invalid rate: %s", ratestr)
+	}
+	burst := rate
+	if hasBurst {
+		burst, err = strconv.ParseFloat(burststr, 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst: %s", burststr)
+		}
+	}
+	return newTokenBucket(rate, burst), nil
+}
+
+// parseCoPPOptions sets the policers from CLASS=RATE[/BURST],...
+func parseCoPPOptions(s string) error {
+	for _, param := range parseInterfaceList(s) {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return fmt.Errorf("expected class=rate[/burst]: %s", param)
+		}
+		class, ok := coppClassByName(name)
+		if !ok {
+			return fmt.Errorf("unknown class: %s", name)
+		}
+		bucket, err := parseRateBurst(value)
+		if err != nil {
+			return err
+		}
+		coppPolicers[class] = bucket
+	}
+	return nil
+}
+
+func coppClassByName(name string) (coppClass, bool) {
+	for class, className := range coppClassNames {
+		if className == name {
+			return class, true
+		}
+	}
+	return 0, false
+}
+
+// coppClassify returns the class of the IP packet destined to the router.
+// payload is the data following the IP header.
+func coppClassify(ipheader *ipHeader, payload []byte) coppClass {
+	switch ipheader.protocol {
+	case IpProtocolNumICMP:
+		return coppClassICMP
+	case IpProtocolNumOSPF:
+		return coppClassRouting
+	case IpProtocolNumTCP, IpProtocolNumUDP:
+		if len(payload) < 4 {
+			return coppClassOther
+		}
+		srcPort := byteToUint16(payload[0:2])
+		dstPort := byteToUint16(payload[2:4])
+		switch {
+		case ipheader.protocol == IpProtocolNumTCP && (dstPort == PORT_BGP || srcPort == PORT_BGP),
+			ipheader.protocol == IpProtocolNumUDP && dstPort == PORT_RIP:
+			return coppClassRouting
+		case ipheader.protocol == IpProtocolNumTCP && (dstPort == PORT_SSH || dstPort == PORT_TELNET),
+			ipheader.protocol == IpProtocolNumUDP && dstPort == PORT_SNMP:
+			return coppClassManagement
+		}
+	}
+	return coppClassOther
+}
+
+// coppCheck returns false when the packet of the class exceeds its policer
+func coppCheck(netdev *netDevice, class coppClass, packet []byte) bool {
+	if coppPolicers[class].allow(clock.Now()) {
+		return true
+	}
+	metricCoPPDrops.inc(class.String())
+	dropPacket(netdev, dropReasonCoPPExceeded, packet)
+	return false
+}
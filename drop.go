@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+)
+
+// dropLogSampleRate logs one of every N dropped packets with its hexdump. 0 disables logging.
+var dropLogSampleRate uint64
+
+var dropLogCount atomic.Uint64
+
+var metricPacketDrops = newCounterVec(
+	"curo_packet_drops_total",
+	"Number of discarded packets by interface and reason.",
+	"device", "reason",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricPacketDrops)
+}
+
+// dropReason describes why a received packet was discarded
+type dropReason uint8
+
+const (
+	dropReasonFrameTooShort dropReason = iota
+	dropReasonFrameTooLong
+	dropReasonNotOurMacAddress
+	dropReasonUnsupportedEtherType
+	dropReasonArpTooShort
+	dropReasonArpUnsupportedProtocol
+	dropReasonArpInvalidHardwareLen
+	dropReasonArpInvalidProtocolLen
+	dropReasonArpUnknownOperation
+	dropReasonArpNotForUs
+	dropReasonIPNoAddress
+	dropReasonIPTooShort
+	dropReasonIPUnsupportedVersion
+	dropReasonIPInvalidVersion
+	dropReasonIPInvalidHeaderLength
+	dropReasonIPChecksumInvalid
+	dropReasonIPInvalidTotalLength
+	dropReasonIPMartianSource
+	dropReasonIPMartianDestination
+	dropReasonIPOptionInvalid
+	dropReasonIPSourceRouted
+	dropReasonIPNotForwarded
+	dropReasonIPUnsupportedProtocol
+	dropReasonACLDenied
+	dropReasonFirewallDenied
+	dropReasonURPFFailed
+	dropReasonCoPPExceeded
+	dropReasonArpInspectionFailed
+	dropReasonIPFragmentationNeeded
+	dropReasonIPFragmentInvalid
+	dropReasonIPFragmentOverlap
+	dropReasonIPReassemblyTimeout
+	dropReasonIPReassemblyMemory
+	dropReasonIPNoRoute
+	dropReasonIPTTLExceeded
+	dropReasonIPSourceRouteFailed
+	dropReasonICMPChecksumInvalid
+	dropReasonTransportChecksumInvalid
+	dropReasonICMPTooShort
+	dropReasonUnsupportedMulticast
+	dropReasonHandlerPanic
+)
+
+var dropReasonNames = map[dropReason]string{
+	dropReasonFrameTooShort:            "frame_too_short",
+	dropReasonFrameTooLong:             "frame_too_long",
+	dropReasonNotOurMacAddress:         "not_our_mac_address",
+	dropReasonUnsupportedEtherType:     "unsupported_ether_type",
+	dropReasonArpTooShort:              "arp_too_short",
+	dropReasonArpUnsupportedProtocol:   "arp_unsupported_protocol",
+	dropReasonArpInvalidHardwareLen:    "arp_invalid_hardware_len",
+	dropReasonArpInvalidProtocolLen:    "arp_invalid_protocol_len",
+	dropReasonArpUnknownOperation:      "arp_unknown_operation",
+	dropReasonArpNotForUs:              "arp_not_for_us",
+	dropReasonIPNoAddress:              "ip_no_address",
+	dropReasonIPTooShort:               "ip_too_short",
+	dropReasonIPUnsupportedVersion:     "ip_unsupported_version",
+	dropReasonIPInvalidVersion:         "ip_invalid_version",
+	dropReasonIPInvalidHeaderLength:    "ip_invalid_header_length",
+	dropReasonIPChecksumInvalid:        "ip_checksum_invalid",
+	dropReasonIPInvalidTotalLength:     "ip_invalid_total_length",
+	dropReasonIPMartianSource:          "ip_martian_source",
+	dropReasonIPMartianDestination:     "ip_martian_destination",
+	dropReasonIPOptionInvalid:          "ip_option_invalid",
+	dropReasonIPSourceRouted:           "ip_source_routed",
+	dropReasonIPNotForwarded:           "ip_not_forwarded",
+	dropReasonIPUnsupportedProtocol:    "ip_unsupported_protocol",
+	dropReasonACLDenied:                "acl_denied",
+	dropReasonFirewallDenied:           "firewall_denied",
+	dropReasonURPFFailed:               "urpf_failed",
+	dropReasonCoPPExceeded:             "copp_exceeded",
+	dropReasonArpInspectionFailed:      "arp_inspection_failed",
+	dropReasonIPFragmentationNeeded:    "ip_fragmentation_needed",
+	dropReasonIPFragmentInvalid:        "ip_fragment_invalid",
+	dropReasonIPFragmentOverlap:        "ip_fragment_overlap",
+	dropReasonIPReassemblyTimeout:      "ip_reassembly_timeout",
+	dropReasonIPReassemblyMemory:       "ip_reassembly_memory",
+	dropReasonIPNoRoute:                "ip_no_route",
+	dropReasonIPTTLExceeded:            "ip_ttl_exceeded",
+	dropReasonIPSourceRouteFailed:      "ip_source_route_failed",
+	dropReasonICMPChecksumInvalid:      "icmp_checksum_invalid",
+	dropReasonTransportChecksumInvalid: "transport_checksum_invalid",
+	dropReasonICMPTooShort:             "icmp_too_short",
+	dropReasonUnsupportedMulticast:     "unsupported_multicast",
+	dropReasonHandlerPanic:             "handler_panic",
+}
+
+func (reason dropReason) String() string {
+	if name, ok := dropReasonNames[reason]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// dropPacket records that the packet received on netdev was discarded
+func dropPacket(netdev *netDevice, reason dropReason, packet []byte) {
+	netdev.stats.rxDropped.Add(1)
+	metricPacketDrops.inc(netdev.name, reason.String())
+
+	if dropLogSampleRate == 0 {
+		return
+	}
+	if dropLogCount.Add(1)%dropLogSampleRate != 0 {
+		return
+	}
+	log.Printf("dropped packet on %s: reason=%s, length=%d\n%s",
+		netdev.name, reason, len(packet), hex.Dump(packet),
+	)
+}
@@ -1,9 +1,6 @@
 package main
 
-import (
-	"bytes"
-	"fmt"
-)
+import "fmt"
 
 const (
 	ETHER_TYPE_IP        = 0x0800
@@ -14,6 +11,17 @@ const (
 
 var ETHERNET_ADDERSS_BROADCAST = [6]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
+// isGroupMacAddr returns true for the multicast and broadcast MAC addresses
+func isGroupMacAddr(addr [6]uint8) bool {
+	return addr[0]&0x01 != 0
+}
+
+// isIPv4MulticastMacAddr returns true for 01:00:5e:00:00:00/25, which the IPv4 multicast
+// groups are mapped to (RFC 1112 6.4)
+func isIPv4MulticastMacAddr(addr [6]uint8) bool {
+	return addr[0] == 0x01 && addr[1] == 0x00 && addr[2] == 0x5e && addr[3]&0x80 == 0
+}
+
 type ethernetHeader struct {
 	destAddr  [6]uint8 // destination MAC address
 	srcAddr   [6]uint8 // source MAC address
@@ -21,11 +29,9 @@ type ethernetHeader struct {
 }
 
 func (header ethernetHeader) ToPacket() []byte {
-	var b bytes.Buffer
-	b.Write(macToByte(header.destAddr))
-	b.Write(macToByte(header.srcAddr))
-	b.Write(uint16ToBytes(header.etherType))
-	return b.Bytes()
+	b := make([]byte, ETHERNET_HEADER_LEN)
+	header.encode(b)
+	return b
 }
 
 func setMacAddr(macAddrByte []byte) (result [6]uint8) {
@@ -40,43 +46,70 @@ func macToByte(addr [6]uint8) (b []byte) {
 	return
 }
 
-// ethernetInput processes the received data in ethernet
-func ethernetInput(netdev *netDevice, packet []byte) error {
+// parseEthernetHeader parses the ethernet header. The packet must be at least 14 bytes.
+func parseEthernetHeader(packet []byte) ethernetHeader {
+	v := ethernetView(packet)
+	return ethernetHeader{
+		destAddr:  v.destAddr(),
+		srcAddr:   v.srcAddr(),
+		etherType: v.etherType(),
+	}
+}
+
+// ethernetInput processes the received frame in pb. The ethernet header is pulled
+// before passing the payload to the upper layer, so that it can be prepended again in place.
+func ethernetInput(netdev *netDevice, pb *packetBuffer) error {
+	packet := pb.bytes()
+	if len(packet) < ETHERNET_HEADER_LEN {
+		dropPacket(netdev, dropReasonFrameTooShort, packet)
+		return fmt.Errorf("invalid ethernet frame: length is too short (length=%d)", len(packet))
+	}
+
 	// parse data as ethernet frame
-	netdev.etheHeader.destAddr = setMacAddr(packet[0:6])
-	netdev.etheHeader.srcAddr = setMacAddr(packet[6:12])
-	netdev.etheHeader.etherType = byteToUint16(packet[12:14])
+	ethHeader := parseEthernetHeader(packet)
 
-	if netdev.macaddr != netdev.etheHeader.destAddr && netdev.etheHeader.destAddr != ETHERNET_ADDERSS_BROADCAST {
+	switch {
+	case ethHeader.destAddr == netdev.macaddr, ethHeader.destAddr == ETHERNET_ADDERSS_BROADCAST:
+	case isIPv4MulticastMacAddr(ethHeader.destAddr):
+		// e.g. IGMP and RSVP to the link-local groups
+	case isGroupMacAddr(ethHeader.destAddr):
+		// the other groups, e.g. IPv6 multicast and the bridge protocols
+		dropPacket(netdev, dropReasonUnsupportedMulticast, packet)
+		return nil
+	default:
+		dropPacket(netdev, dropReasonNotOurMacAddress, packet)
 		return nil
 	}
 
+	metricEtherTypeInput.inc(etherTypeName(ethHeader.etherType))
+
 	// detect protocol of upper layer
-	switch netdev.etheHeader.etherType {
+	switch ethHeader.etherType {
 	case ETHER_TYPE_ARP:
-		if err := arpInput(netdev, packet[14:]); err != nil {
+		if err := arpInput(netdev, ethHeader, ethernetView(packet).payload()); err != nil {
 			return fmt.Errorf("failed to input ARP packet: %w", err)
 		}
 	case ETHER_TYPE_IP:
-		if err := ipInput(netdev, packet[14:]); err != nil {
+		pb.pull(ETHERNET_HEADER_LEN)
+		if err := ipInput(netdev, ethHeader, pb); err != nil {
 			return fmt.Errorf("failed to input IP packet: %w", err)
 		}
+	default:
+		dropPacket(netdev, dropReasonUnsupportedEtherType, packet)
 	}
 
 	return nil
 }
 
-// ethernetOutput sends ethernet packet
-func ethernetOutput(netdev *netDevice, destAddr [6]uint8, packet []byte, ethType uint16) error {
-	// create ethernet header packet
-	ethHeaderPacket := ethernetHeader{
+// ethernetOutputBuffer prepends the ethernet header into the headroom of pb and sends it
+func ethernetOutputBuffer(netdev *netDevice, destAddr [6]uint8, pb *packetBuffer, ethType uint16) error {
+	ethernetHeader{
 		destAddr:  destAddr,
 		srcAddr:   netdev.macaddr,
 		etherType: ethType,
-	}.ToPacket()
+	}.encode(pb.prepend(ETHERNET_HEADER_LEN))
 
-	ethHeaderPacket = append(ethHeaderPacket, packet...)
-	if err := netdev.netDeviceTransmit(ethHeaderPacket); err != nil {
+	if err := netdev.netDeviceTransmit(pb.bytes()); err != nil {
 		return fmt.Errorf("failed to output ethernet: %v", err)
 	}
 
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// packetFilter selects frames by an expression like tcpdump, e.g.
+//
+//	arp or (ip and dst net 192.168.2.0/24 and udp port 53)
+//
+// Primitives:
+//
+//	ether [src|dst] host MAC, arp, ip, ip6, icmp, tcp, udp, proto N,
+//	[src|dst] host ADDR, [src|dst] net ADDR/PREFIX, [tcp|udp] [src|dst] port N,
+//	icmp-type N
+//
+// Primitives are combined with and (&&), or (||), not (!) and parentheses.
+type packetFilter struct {
+	expr string
+	root filterNode
+}
+
+// packetInfo is the fields of a frame the filter matches on
+type packetInfo struct {
+	eth ethernetHeader
+
+	hasArp bool
+	arp    arpIPToEthernet
+
+	hasIP bool
+	ip    ipHeader
+
+	// ports of TCP and UDP, only in the first fragment
+	hasPorts bool
+	srcPort  uint16
+	dstPort  uint16
+
+	hasICMP  bool
+	icmpType uint8
+
+	// TCP flags in the first fragment
+	tcpFlags uint8
+	// the upper layer header and payload, only in the first fragment
+	l4 []byte
+}
+
+// parsePacketInfo parses the headers of the frame as far as possible
+func parsePacketInfo(frame []byte) (info packetInfo) {
+	if len(frame) < 14 {
+		return info
+	}
+	info.eth = parseEthernetHeader(frame)
+	payload := frame[14:]
+
+	switch info.eth.etherType {
+	case ETHER_TYPE_ARP:
+		if len(payload) >= 28 {
+			info.hasArp = true
+			info.arp = parseArpPacket(payload)
+		}
+	case ETHER_TYPE_IP:
+		info.parseIP(payload)
+	}
+	return info
+}
+
+// parseIP parses the IP header and the ports or the ICMP type
+func (info *packetInfo) parseIP(packet []byte) {
+	if len(packet) < 20 {
+		return
+	}
+	info.hasIP = true
+	info.ip = parseIPHeader(packet)
+
+	// the upper layer header is only in the first fragment
+	headerLen := int(info.ip.headerLen) * 4
+	if info.ip.fragmentOffset&0x1fff != 0 || headerLen < 20 || len(packet) < headerLen {
+		return
+	}
+	l4 := packet[headerLen:]
+	info.l4 = l4
+	switch info.ip.protocol {
+	case IpProtocolNumTCP, IpProtocolNumUDP:
+		if len(l4) >= 4 {
+			info.hasPorts = true
+			info.srcPort = byteToUint16(l4[0:2])
+			info.dstPort = byteToUint16(l4[2:4])
+		}
+		if info.ip.protocol == IpProtocolNumTCP && len(l4) >= 14 {
+			info.tcpFlags = l4[13]
+		}
+	case IpProtocolNumICMP:
+		if len(l4) >= 1 {
+			info.hasICMP = true
+			info.icmpType = l4[0]
+		}
+	}
+}
+
+// compilePacketFilter compiles the expression. An empty expression returns nil which matches everything.
+func compilePacketFilter(expr string) (*packetFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return &packetFilter{expr: expr, root: root}, nil
+}
+
+// match returns true when the frame matches the filter. A nil filter matches everything.
+func (f *packetFilter) match(frame []byte) bool {
+	if f == nil {
+		return true
+	}
+	info := parsePacketInfo(frame)
+	return f.root.match(&info)
+}
+
+func (f *packetFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+type filterNode interface {
+	match(info *packetInfo) bool
+}
+
+type filterDirection uint8
+
+const (
+	filterDirectionAny filterDirection = iota
+	filterDirectionSrc
+	filterDirectionDst
+)
+
+type (
+	filterAnd struct{ left, right filterNode }
+	filterOr  struct{ left, right filterNode }
+	filterNot struct{ node filterNode }
+
+	filterEtherType struct{ etherType uint16 }
+	filterIPProto   struct{ protocol uint8 }
+	filterICMPType  struct{ icmpType uint8 }
+
+	filterEtherHost struct {
+		dir     filterDirection
+		macaddr [6]uint8
+	}
+	filterNet struct {
+		dir     filterDirection
+		address IpAddress
+		netmask uint32
+	}
+	filterPort struct {
+		dir filterDirection
+		// 0 matches both TCP and UDP
+		protocol uint8
+		port     uint16
+	}
+)
+
+func (n filterAnd) match(info *packetInfo) bool { return n.left.match(info) && n.right.match(info) }
+func (n filterOr) match(info *packetInfo) bool  { return n.left.match(info) || n.right.match(info) }
+func (n filterNot) match(info *packetInfo) bool { return !n.node.match(info) }
+
+func (n filterEtherType) match(info *packetInfo) bool {
+	return info.eth.etherType == n.etherType
+}
+
+func (n filterIPProto) match(info *packetInfo) bool {
+	return info.hasIP && info.ip.protocol == n.protocol
+}
+
+func (n filterICMPType) match(info *packetInfo) bool {
+	return info.hasICMP && info.icmpType == n.icmpType
+}
+
+func (n filterEtherHost) match(info *packetInfo) bool {
+	return matchDirection(n.dir, info.eth.srcAddr == n.macaddr, info.eth.destAddr == n.macaddr)
+}
+
+// match checks the IP addresses, or the sender and target addresses of ARP
+func (n filterNet) match(info *packetInfo) bool {
+	inNet := func(addr IpAddress) bool {
+		return uint32(addr)&n.netmask == uint32(n.address)&n.netmask
+	}
+	switch {
+	case info.hasIP:
+		return matchDirection(n.dir, inNet(info.ip.srcAddr), inNet(info.ip.destAddr))
+	case info.hasArp:
+		return matchDirection(n.dir, inNet(info.arp.senderIPAddr), inNet(info.arp.targetIPAddr))
+	}
+	return false
+}
+
+func (n filterPort) match(info *packetInfo) bool {
+	if !info.hasPorts || (n.protocol != 0 && info.ip.protocol != n.protocol) {
+		return false
+	}
+	return matchDirection(n.dir, info.srcPort == n.port, info.dstPort == n.port)
+}
+
+func matchDirection(dir filterDirection, src, dst bool) bool {
+	switch dir {
+	case filterDirectionSrc:
+		return src
+	case filterDirectionDst:
+		return dst
+	default:
+		return src || dst
+	}
+}
+
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case c == '!' && (i+1 == len(expr) || expr[i+1] != '='):
+			flush()
+			tokens = append(tokens, "not")
+		case strings.HasPrefix(expr[i:], "&&"):
+			flush()
+			tokens = append(tokens, "and")
+			i++
+		case strings.HasPrefix(expr[i:], "||"):
+			flush()
+			tokens = append(tokens, "or")
+			i++
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	return token, nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.peek() == "not" {
+		p.pos++
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node: node}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token, err := p.next(); err != nil || token != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return node, nil
+	case "arp":
+		return filterEtherType{etherType: ETHER_TYPE_ARP}, nil
+	case "ip":
+		return filterEtherType{etherType: ETHER_TYPE_IP}, nil
+	case "ip6":
+		return filterEtherType{etherType: ETHER_TYPE_IPV6}, nil
+	case "icmp":
+		return filterIPProto{protocol: IpProtocolNumICMP}, nil
+	case "tcp", "udp":
+		protocol := IpProtocolNumTCP
+		if token == "udp" {
+			protocol = IpProtocolNumUDP
+		}
+		// "udp port 53" restricts the port to the protocol
+		switch p.peek() {
+		case "port", "src", "dst":
+			return p.parsePort(protocol)
+		}
+		return filterIPProto{protocol: protocol}, nil
+	case "proto":
+		v, err := p.parseNumber(0xff)
+		if err != nil {
+			return nil, err
+		}
+		return filterIPProto{protocol: uint8(v)}, nil
+	case "icmp-type":
+		v, err := p.parseNumber(0xff)
+		if err != nil {
+			return nil, err
+		}
+		return filterICMPType{icmpType: uint8(v)}, nil
+	case "ether":
+		return p.parseEtherHost()
+	}
+
+	// [src|dst] host|net|port
+	p.pos--
+	dir := p.parseDirection()
+	token, err = p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "host":
+		addr, err := p.parseAddress()
+		if err != nil {
+			return nil, err
+		}
+		return filterNet{dir: dir, address: addr, netmask: 0xffffffff}, nil
+	case "net":
+		token, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		_, ipnet, err := net.ParseCIDR(token)
+		if err != nil || ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid network: %s", token)
+		}
+		return filterNet{
+			dir:     dir,
+			address: IpAddress(byteToUint32(ipnet.IP.To4())),
+			netmask: byteToUint32(ipnet.Mask),
+		}, nil
+	case "port":
+		p.pos--
+		if dir != filterDirectionAny {
+			p.pos--
+		}
+		return p.parsePort(0)
+	}
+	return nil, fmt.Errorf("unknown primitive: %s", token)
+}
+
+func (p *filterParser) parseDirection() filterDirection {
+	switch p.peek() {
+	case "src":
+		p.pos++
+		return filterDirectionSrc
+	case "dst":
+		p.pos++
+		return filterDirectionDst
+	}
+	return filterDirectionAny
+}
+
+func (p *filterParser) parsePort(protocol uint8) (filterNode, error) {
+	dir := p.parseDirection()
+	if token, err := p.next(); err != nil || token != "port" {
+		return nil, fmt.Errorf("expected port")
+	}
+	v, err := p.parseNumber(0xffff)
+	if err != nil {
+		return nil, err
+	}
+	return filterPort{dir: dir, protocol: protocol, port: uint16(v)}, nil
+}
+
+func (p *filterParser) parseEtherHost() (filterNode, error) {
+	dir := p.parseDirection()
+	if token, err := p.next(); err != nil || token != "host" {
+		return nil, fmt.Errorf("expected host after ether")
+	}
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	macaddr, err := net.ParseMAC(token)
+	if err != nil || len(macaddr) != ETHERNET_ADDRESS_LEN {
+		return nil, fmt.Errorf("invalid MAC address: %s", token)
+	}
+	return filterEtherHost{dir: dir, macaddr: setMacAddr(macaddr)}, nil
+}
+
+func (p *filterParser) parseAddress() (IpAddress, error) {
+	token, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+	ip := net.ParseIP(token).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("invalid IP address: %s", token)
+	}
+	return IpAddress(byteToUint32(ip)), nil
+}
+
+func (p *filterParser) parseNumber(max uint64) (uint64, error) {
+	token, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(token, 0, 64)
+	if err != nil || v > max {
+		return 0, fmt.Errorf("invalid number: %s", token)
+	}
+	return v, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// flowKey identifies a flow by the 5-tuple.
+// ICMP query messages use the identifier as the source port and 0 as the destination port.
+// The key is shared by the connection tracking and the address translation.
+type flowKey struct {
+	srcAddr  IpAddress
+	dstAddr  IpAddress
+	srcPort  uint16
+	dstPort  uint16
+	protocol uint8
+}
+
+func (key flowKey) String() string {
+	return fmt.Sprintf("%s src=%s dst=%s sport=%d dport=%d",
+		ipProtocolName(key.protocol), key.srcAddr, key.dstAddr, key.srcPort, key.dstPort)
+}
+
+// reverse returns the key of the packets in the opposite direction
+func (key flowKey) reverse() flowKey {
+	reversed := flowKey{
+		srcAddr:  key.dstAddr,
+		dstAddr:  key.srcAddr,
+		srcPort:  key.dstPort,
+		dstPort:  key.srcPort,
+		protocol: key.protocol,
+	}
+	if key.protocol == IpProtocolNumICMP {
+		// the identifier is the same in the request and the reply
+		reversed.srcPort, reversed.dstPort = key.srcPort, key.dstPort
+	}
+	return reversed
+}
+
+// flowKeyFromPacket returns the key of the parsed IP packet.
+// It returns false for fragments without the upper layer header and ICMP error messages.
+func flowKeyFromPacket(info *packetInfo) (flowKey, bool) {
+	if !info.hasIP {
+		return flowKey{}, false
+	}
+	key := flowKey{
+		srcAddr:  info.ip.srcAddr,
+		dstAddr:  info.ip.destAddr,
+		protocol: info.ip.protocol,
+	}
+
+	switch info.ip.protocol {
+	case IpProtocolNumTCP, IpProtocolNumUDP:
+		if !info.hasPorts {
+			return flowKey{}, false
+		}
+		key.srcPort = info.srcPort
+		key.dstPort = info.dstPort
+	case IpProtocolNumICMP:
+		if !info.hasICMP || !isICMPQuery(info.icmpType) || len(info.l4) < 6 {
+			return flowKey{}, false
+		}
+		key.srcPort = byteToUint16(info.l4[4:6])
+	}
+	return key, true
+}
+
+// isICMPQuery returns true for the ICMP messages which have an identifier
+func isICMPQuery(icmpType uint8) bool {
+	switch icmpType {
+	case ICMP_TYPE_ECHO_REQUEST, ICMP_TYPE_ECHO_REPLY, ICMP_TYPE_TIMESTAMP, ICMP_TYPE_TIMESTAMP_REPLY:
+		return true
+	}
+	return false
+}
+
+// isICMPError returns true for the ICMP messages which contain the packet causing the error
+func isICMPError(icmpType uint8) bool {
+	switch icmpType {
+	case ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_TYPE_SOURCE_QUENCH, ICMP_TYPE_REDIRECT,
+		ICMP_TYPE_TIME_EXCEEDED, ICMP_TYPE_PARAM_PROBLEM:
+		return true
+	}
+	return false
+}
+
+// icmpErrorInnerFlowKey returns the key of the packet contained in the ICMP error message
+func icmpErrorInnerFlowKey(info *packetInfo) (flowKey, bool) {
+	if !info.hasICMP || !isICMPError(info.icmpType) || len(info.l4) < 8 {
+		return flowKey{}, false
+	}
+	var inner packetInfo
+	inner.parseIP(info.l4[8:])
+	return flowKeyFromPacket(&inner)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// ipForwarding routes the received packets not destined to the router
+var ipForwarding bool
+
+// ipForward routes the packet in pb received on inputdev which is not destined to the router
+// to the next hop. The TTL is decremented and the ethernet header prepended in place of the
+// received frame.
+func ipForward(inputdev *netDevice, ethHeader ethernetHeader, ipheader *ipHeader, pb *packetBuffer) error {
+	packet := pb.bytes()
+	// the link layer broadcast and multicast and the IP multicast are not routed (RFC 1812 5.3.4)
+	if !ipForwarding || isGroupMacAddr(ethHeader.destAddr) || uint32(ipheader.destAddr)>>28 == 0xe {
+		metricForwardDecision.inc("not_forwarded")
+		dropPacket(inputdev, dropReasonIPNotForwarded, packet)
+		return nil
+	}
+
+	outputdev, nexthop := ipRouteLookup(ipheader.destAddr)
+	if outputdev == nil {
+		metricForwardDecision.inc("no_route")
+		dropPacket(inputdev, dropReasonIPNoRoute, packet)
+		return icmpSendError(inputdev, ipheader, packet, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_NET_UNREACHABLE, 0)
+	}
+	if ipheader.ttl <= 1 {
+		metricForwardDecision.inc("ttl_exceeded")
+		dropPacket(inputdev, dropReasonIPTTLExceeded, packet)
+		return icmpSendError(inputdev, ipheader, packet, ICMP_TYPE_TIME_EXCEEDED, ICMP_CODE_TTL_EXCEEDED_IN_TRANSIT, 0)
+	}
+	if !aclCheckEgress(outputdev, inputdev, packet) {
+		metricForwardDecision.inc("acl_denied")
+		return nil
+	}
+
+	ipv4View(packet).setTTL(ipheader.ttl - 1)
+	destMacAddr, _ := searchArpTableEntry(nexthop)
+	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
+		// the packet waits for the ARP reply
+		metricForwardDecision.inc("unresolved")
+		if err := arpQueuePending(outputdev, inputdev, nexthop, packet); err != nil {
+			return err
+		}
+		return sendArpRequest(outputdev, nexthop)
+	}
+
+	log.Printf("Forwarding IP packet to %s via %s", ipheader.destAddr, outputdev.name)
+	metricForwardDecision.inc("forwarded")
+	return ipForwardOutput(inputdev, outputdev, destMacAddr, ipheader, pb)
+}
+
+// ipSourceRouteForward forwards the source routed packet addressed to the router to the next
+// address of the route, recording the address of the output device in its place (RFC 791).
+// The next address of the strict source route must be on a connected network.
+func ipSourceRouteForward(inputdev *netDevice, ethHeader ethernetHeader, ipheader *ipHeader, opts ipOptions, next IpAddress, pb *packetBuffer) error {
+	packet := pb.bytes()
+	if !ipForwarding {
+		metricForwardDecision.inc("not_forwarded")
+		dropPacket(inputdev, dropReasonIPNotForwarded, packet)
+		return nil
+	}
+
+	header := ipv4View(packet).header()
+	outputdev, nexthop := ipRouteLookup(next)
+	if outputdev == nil || header[opts.sourceRoute] == IP_OPTION_STRICT_SOURCE_ROUTE && nexthop != next {
+		metricForwardDecision.inc("source_route_failed")
+		dropPacket(inputdev, dropReasonIPSourceRouteFailed, packet)
+		return icmpSendError(inputdev, ipheader, packet, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_SOURCE_ROUTE_FAILED, 0)
+	}
+
+	ptr := int(header[opts.sourceRoute+2])
+	copy(header[opts.sourceRoute+ptr-1:], uint32ToBytes(uint32(outputdev.ipdev().address)))
+	header[opts.sourceRoute+2] += 4
+	copy(header[16:20], uint32ToBytes(uint32(next)))
+	ipv4View(packet).updateChecksum()
+	ipheader.destAddr = next
+	ipheader.headerChecksum = ipv4View(packet).headerChecksum()
+
+	return ipForward(inputdev, ethHeader, ipheader, pb)
+}
+
+// ipForwardOutput sends the packet in pb received on inputdev out of outputdev with its options.
+// When the packet exceeds the MTU of outputdev and DF is set, ICMP fragmentation needed
+// with the MTU is sent back to the source instead.
+func ipForwardOutput(inputdev, outputdev *netDevice, destMacAddr [6]uint8, ipheader *ipHeader, pb *packetBuffer) error {
+	packet := pb.bytes()
+	if err := ipOptionsForward(outputdev, packet); err != nil {
+		return err
+	}
+	err := ipOutputBuffer(outputdev, destMacAddr, pb)
+	if !errors.Is(err, errFragmentationNeeded) {
+		return err
+	}
+	dropPacket(inputdev, dropReasonIPFragmentationNeeded, packet)
+	return icmpSendError(inputdev, ipheader, packet, ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_CODE_FRAGMENTATION_NEEDED, uint32(outputdev.mtu))
+}
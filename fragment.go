@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	IpDefaultMTU = 1500
+	// every link must forward the datagram of 68 bytes without fragmentation (RFC 791)
+	IpMinimumMTU = 68
+
+	IP_FLAG_DF uint16 = 0x4000
+	IP_FLAG_MF uint16 = 0x2000
+	// the fragment offset in units of 8 bytes
+	IP_FRAGMENT_OFFSET_MASK uint16 = 0x1fff
+)
+
+// mtuOptions are the MTU overrides given on the command line, e.g. router1-router2=1400
+var mtuOptions string
+
+// errFragmentationNeeded is returned when the packet exceeds the MTU and DF is set
+var errFragmentationNeeded = errors.New("fragmentation needed and DF set")
+
+// ipIdentification is the identification of the next packet originated by the router
+var ipIdentification atomic.Uint32
+
+var metricIPFragmentsCreated = newCounterVec(
+	"curo_ip_fragments_created_total",
+	"Number of fragments created from the packets exceeding the MTU.",
+	"device",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricIPFragmentsCreated)
+}
+
+// setupMTU overrides the MTU of the devices in netDeviceList
+func setupMTU() error {
+	for _, param := range parseInterfaceList(mtuOptions) {
+		name, mtustr, ok := strings.Cut(param, "=")
+		if !ok {
+			return fmt.Errorf("expected interface=mtu: %s", param)
+		}
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("device %s is not found", name)
+		}
+		mtu, err := strconv.Atoi(mtustr)
+		if err != nil || mtu < IpMinimumMTU || mtu > 0xffff {
+			return fmt.Errorf("invalid MTU: %s", mtustr)
+		}
+		netdev.mtu = mtu
+		log.Printf("Set MTU of %s to %d", name, mtu)
+	}
+	return nil
+}
+
+// nextIPIdentification returns the identification for a packet originated by the router
+func nextIPIdentification() uint16 {
+	return uint16(ipIdentification.Add(1))
+}
+
+// ipFragment splits the IP packet exceeding the mtu into fragments which fit in it, each built
+// behind the headroom of the ethernet header. The fragments must be freed by the caller.
+// The options without the copied flag are only in the first fragment.
+func ipFragment(packet []byte, mtu int) ([]*packetBuffer, error) {
+	headerLen := ipv4View(packet).headerLen()
+	flags := ipv4View(packet).fragmentOffset()
+	if flags&IP_FLAG_DF != 0 {
+		return nil, errFragmentationNeeded
+	}
+	firstHeader := packet[:headerLen]
+	otherHeader := ipFragmentHeader(firstHeader)
+	if len(otherHeader)+8 > mtu || headerLen+8 > mtu {
+		return nil, fmt.Errorf("MTU %d is too small for the header", mtu)
+	}
+
+	offset := flags & IP_FRAGMENT_OFFSET_MASK
+	moreFragments := flags & IP_FLAG_MF
+	payload := packet[headerLen:]
+
+	var fragments []*packetBuffer
+	header := firstHeader
+	for len(payload) > 0 {
+		size := len(payload)
+		mf := moreFragments
+		if len(header)+size > mtu {
+			// the data of the fragments other than the last is a multiple of 8 bytes
+			size = (mtu - len(header)) &^ 7
+			mf = IP_FLAG_MF
+		}
+
+		pb := getPacketBuffer(ETHERNET_HEADER_LEN, len(header)+size)
+		copy(pb.append(len(header)), header)
+		copy(pb.append(size), payload[:size])
+		v := ipv4View(pb.bytes())
+		v.setTotalLen(uint16(len(header) + size))
+		v.setFragmentOffset(mf | offset)
+		v.updateChecksum()
+		fragments = append(fragments, pb)
+
+		payload = payload[size:]
+		offset += uint16(size / 8)
+		header = otherHeader
+	}
+	return fragments, nil
+}
+
+// ipFragmentHeader returns the header of the fragments other than the first,
+// which keeps only the options with the copied flag
+func ipFragmentHeader(header []byte) []byte {
+	if len(header) == 20 {
+		return header
+	}
+
+	b := append([]byte{}, header[:20]...)
+	options := header[20:]
+	for len(options) > 0 {
+		optionType := options[0]
+		if optionType == IP_OPTION_END {
+			break
+		}
+		if optionType == IP_OPTION_NOP {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			break
+		}
+		optionLen := int(options[1])
+		if optionType&IP_OPTION_COPIED != 0 {
+			b = append(b, options[:optionLen]...)
+		}
+		options = options[optionLen:]
+	}
+	// pad the options to a multiple of 4 bytes
+	for len(b)%4 != 0 {
+		b = append(b, IP_OPTION_END)
+	}
+	b[0] = b[0]&0xf0 | uint8(len(b)/4)
+	return b
+}
+
+// ipOutputBuffer sends the IP packet in pb to destMacAddr via netdev, fragmenting it by the MTU
+// of netdev. The ethernet header is prepended in place unless the packet needs fragmentation.
+func ipOutputBuffer(netdev *netDevice, destMacAddr [6]uint8, pb *packetBuffer) error {
+	if len(pb.bytes()) <= netdev.mtu {
+		return ethernetOutputBuffer(netdev, destMacAddr, pb, ETHER_TYPE_IP)
+	}
+
+	fragments, err := ipFragment(pb.bytes(), netdev.mtu)
+	if err != nil {
+		netdev.stats.txDropped.Add(1)
+		return err
+	}
+	defer func() {
+		for _, fragment := range fragments {
+			fragment.free()
+		}
+	}()
+	metricIPFragmentsCreated.add(uint64(len(fragments)), netdev.name)
+	for _, fragment := range fragments {
+		if err := ethernetOutputBuffer(netdev, destMacAddr, fragment, ETHER_TYPE_IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
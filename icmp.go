@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	ICMP_TYPE_ECHO_REPLY              uint8 = 0
+	ICMP_TYPE_DESTINATION_UNREACHABLE uint8 = 3
+	ICMP_TYPE_SOURCE_QUENCH           uint8 = 4
+	ICMP_TYPE_REDIRECT                uint8 = 5
+	ICMP_TYPE_ECHO_REQUEST            uint8 = 8
+	ICMP_TYPE_TIME_EXCEEDED           uint8 = 11
+	ICMP_TYPE_PARAM_PROBLEM           uint8 = 12
+	ICMP_TYPE_TIMESTAMP               uint8 = 13
+	ICMP_TYPE_TIMESTAMP_REPLY         uint8 = 14
+)
+
+const (
+	ICMP_CODE_NET_UNREACHABLE             uint8 = 0
+	ICMP_CODE_FRAGMENTATION_NEEDED        uint8 = 4
+	ICMP_CODE_SOURCE_ROUTE_FAILED         uint8 = 5
+	ICMP_CODE_ADMINISTRATIVELY_PROHIBITED uint8 = 13
+)
+const (
+	ICMP_CODE_TTL_EXCEEDED_IN_TRANSIT           uint8 = 0
+	ICMP_CODE_FRAGMENT_REASSEMBLY_TIME_EXCEEDED uint8 = 1
+)
+
+type icmpHeader struct {
+	icmpType uint8
+	code     uint8
+	checksum uint16
+	// the rest of the header, e.g. unused or the next-hop MTU
+	rest uint32
+}
+
+// icmpInput processes the ICMP message in pb destined to the router. The echo reply is
+// built in place of the request, and its IP header is prepended into the received buffer.
+func icmpInput(inputdev *netDevice, ipheader *ipHeader, pb *packetBuffer) error {
+	message := pb.bytes()
+	if message[0] != ICMP_TYPE_ECHO_REQUEST {
+		fmt.Println("ICMP received")
+		return nil
+	}
+	// the echo request to a broadcast address is not answered
+	if !ipLocalAddress(ipheader.destAddr) {
+		return nil
+	}
+
+	// only the type differs from the request, the code, identifier, sequence and data are echoed
+	old := byteToUint16(message[0:2])
+	message[0] = ICMP_TYPE_ECHO_REPLY
+	checksum := checksumUpdate16(byteToUint16(message[2:4]), old, byteToUint16(message[0:2]))
+	copy(message[2:4], uint16ToBytes(checksum))
+
+	log.Printf("Sending ICMP echo reply to %s", ipheader.srcAddr)
+	if err := ipPacketEncapsulateOutput(ipheader.srcAddr, ipheader.destAddr, pb, IpProtocolNumICMP); err != nil {
+		return fmt.Errorf("failed to send ICMP echo reply: %w", err)
+	}
+	return nil
+}
+
+// icmpErrorAllowed returns false for the packets no ICMP error is sent about
+// (RFC 1122 3.2.2, RFC 1812 4.3.2.7)
+func icmpErrorAllowed(inputdev *netDevice, ipheader *ipHeader, packet []byte) bool {
+	src, dst := uint32(ipheader.srcAddr), uint32(ipheader.destAddr)
+	switch {
+	case ipheader.destAddr == IpAddressLimitedBroadcast, ipheader.destAddr == inputdev.ipdev().broadcast, dst>>28 == 0xe:
+		// broadcast and multicast
+		return false
+	case src == 0, ipheader.srcAddr == IpAddressLimitedBroadcast, ipheader.srcAddr == inputdev.ipdev().broadcast:
+		// the source does not identify a single host
+		return false
+	case src>>24 == 127, src>>28 == 0xe, src>>28 == 0xf:
+		// loopback, multicast and class E
+		return false
+	case ipheader.fragmentOffset&IP_FRAGMENT_OFFSET_MASK != 0:
+		// only the first fragment
+		return false
+	}
+	headerLen := int(ipheader.headerLen) * 4
+	if ipheader.protocol == IpProtocolNumICMP && len(packet) > headerLen && icmpIsError(packet[headerLen]) {
+		return false
+	}
+	return true
+}
+
+// icmpIsError returns true for the types of the ICMP error messages
+func icmpIsError(icmpType uint8) bool {
+	switch icmpType {
+	case ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_TYPE_SOURCE_QUENCH, ICMP_TYPE_REDIRECT, ICMP_TYPE_TIME_EXCEEDED, ICMP_TYPE_PARAM_PROBLEM:
+		return true
+	}
+	return false
+}
+
+// icmpSendError sends the ICMP error message about the received packet back to its source.
+// packet is the IP packet which caused the error.
+func icmpSendError(inputdev *netDevice, ipheader *ipHeader, packet []byte, icmpType, code uint8, rest uint32) error {
+	if !icmpErrorAllowed(inputdev, ipheader, packet) {
+		return nil
+	}
+	if !icmpErrorLimiter.allow(clock.Now()) {
+		metricICMPErrorsRateLimited.inc()
+		return nil
+	}
+
+	// the IP header and the first 8 bytes of the payload
+	originalLen := int(ipheader.headerLen)*4 + 8
+	if originalLen > len(packet) {
+		originalLen = len(packet)
+	}
+
+	// the message is built behind the headroom of the IP and ethernet headers
+	pb := getPacketBuffer(ETHERNET_HEADER_LEN+IP_HEADER_LEN, ICMP_HEADER_LEN+originalLen)
+	defer pb.free()
+	icmpHeader{
+		icmpType: icmpType,
+		code:     code,
+		rest:     rest,
+	}.encode(pb.append(ICMP_HEADER_LEN))
+	copy(pb.append(originalLen), packet[:originalLen])
+	icmpPacket := pb.bytes()
+	copy(icmpPacket[2:4], uint16ToBytes(icmpChecksum(icmpPacket)))
+
+	log.Printf("Sending ICMP type=%d code=%d to %s", icmpType, code, ipheader.srcAddr)
+	if err := ipPacketEncapsulateOutput(ipheader.srcAddr, 0, pb, IpProtocolNumICMP); err != nil {
+		return fmt.Errorf("failed to send ICMP error: %w", err)
+	}
+	return nil
+}
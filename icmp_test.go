@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestICMPErrorAllowed(t *testing.T) {
+	inputdev := &netDevice{name: "test"}
+	inputdev.ipdevice.Store(&ipDevice{address: 0xc0a80101, netmask: 0xffffff00, broadcast: 0xc0a801ff})
+
+	udp := func(src, dst IpAddress) ipHeader {
+		return ipHeader{version: 4, headerLen: 5, ttl: 1, protocol: IpProtocolNumUDP, srcAddr: src, destAddr: dst}
+	}
+	icmp := func(icmpType uint8) (ipHeader, []byte) {
+		header := ipHeader{version: 4, headerLen: 5, ttl: 1, protocol: IpProtocolNumICMP, srcAddr: 0xc0a80102, destAddr: 0xc0a80202}
+		packet := make([]byte, IP_HEADER_LEN+ICMP_HEADER_LEN)
+		packet[IP_HEADER_LEN] = icmpType
+		return header, packet
+	}
+	fragment := func(offset uint16) ipHeader {
+		header := udp(0xc0a80102, 0xc0a80202)
+		header.fragmentOffset = offset
+		return header
+	}
+	echoRequest, echoRequestPacket := icmp(ICMP_TYPE_ECHO_REQUEST)
+	unreachable, unreachablePacket := icmp(ICMP_TYPE_DESTINATION_UNREACHABLE)
+	timeExceeded, timeExceededPacket := icmp(ICMP_TYPE_TIME_EXCEEDED)
+
+	tests := []struct {
+		name   string
+		header ipHeader
+		packet []byte
+		want   bool
+	}{
+		{"unicast", udp(0xc0a80102, 0xc0a80202), nil, true},
+		{"limited broadcast destination", udp(0xc0a80102, 0xffffffff), nil, false},
+		{"directed broadcast destination", udp(0xc0a80102, 0xc0a801ff), nil, false},
+		{"multicast destination", udp(0xc0a80102, 0xe0000016), nil, false},
+		{"unspecified source", udp(0, 0xc0a80202), nil, false},
+		{"limited broadcast source", udp(0xffffffff, 0xc0a80202), nil, false},
+		{"directed broadcast source", udp(0xc0a801ff, 0xc0a80202), nil, false},
+		{"loopback source", udp(0x7f000001, 0xc0a80202), nil, false},
+		{"multicast source", udp(0xe0000001, 0xc0a80202), nil, false},
+		{"class E source", udp(0xf0000001, 0xc0a80202), nil, false},
+		{"first fragment", fragment(IP_FLAG_MF), nil, true},
+		{"non-first fragment", fragment(IP_FLAG_MF | 185), nil, false},
+		{"last fragment", fragment(185), nil, false},
+		{"echo request", echoRequest, echoRequestPacket, true},
+		{"destination unreachable", unreachable, unreachablePacket, false},
+		{"time exceeded", timeExceeded, timeExceededPacket, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := icmpErrorAllowed(inputdev, &tt.header, tt.packet); got != tt.want {
+				t.Errorf("icmpErrorAllowed() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
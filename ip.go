@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"net"
@@ -12,8 +11,17 @@ const IpAddressLen = 4
 const IpAddressLimitedBroadcast IpAddress = 0xffffffff
 const (
 	IpProtocolNumICMP uint8 = 0x01
+	IpProtocolNumIGMP uint8 = 0x02
 	IpProtocolNumTCP  uint8 = 0x06
 	IpProtocolNumUDP  uint8 = 0x11
+	IpProtocolNumRSVP uint8 = 0x2e
+	IpProtocolNumOSPF uint8 = 0x59
+)
+const (
+	IP_OPTION_END uint8 = 0
+	IP_OPTION_NOP uint8 = 1
+	// the option is copied into all fragments
+	IP_OPTION_COPIED uint8 = 0x80
 )
 const (
 	IpRouteTypeConnected ipRouteType = iota
@@ -23,10 +31,8 @@ const (
 type IpAddress uint32
 
 type ipDevice struct {
-	address IpAddress
-	// nolint: unused
-	netmask uint32
-	// nolint: unused
+	address   IpAddress
+	netmask   uint32
 	broadcast IpAddress
 }
 
@@ -52,28 +58,13 @@ type ipRouteEntry struct {
 
 type ipRouteType uint8
 
-func (i ipHeader) ToPacket(calc bool) (ipHeaderByte []byte) {
-	var b bytes.Buffer
-
-	b.Write([]byte{i.version<<4 + i.headerLen})
-	b.Write([]byte{i.tos})
-	b.Write(uint16ToBytes(i.totalLen))
-	b.Write(uint16ToBytes(i.identify))
-	b.Write(uint16ToBytes(i.fragmentOffset))
-	b.Write([]byte{i.ttl})
-	b.Write([]byte{i.protocol})
-	b.Write(uint16ToBytes(i.headerChecksum))
-	b.Write(uint32ToBytes(uint32(i.srcAddr)))
-	b.Write(uint32ToBytes(uint32(i.destAddr)))
-
+func (i ipHeader) ToPacket(calc bool) []byte {
+	b := make([]byte, IP_HEADER_LEN)
+	i.encode(b)
 	if calc {
-		ipHeaderByte = b.Bytes()
-		checksum := calcCechksum(ipHeaderByte)
-		ipHeaderByte[10] = checksum[0]
-		ipHeaderByte[11] = checksum[1]
+		ipv4View(b).updateChecksum()
 	}
-
-	return ipHeaderByte
+	return b
 }
 
 func printIPAddr(ip uint32) string {
@@ -96,7 +87,8 @@ func getIPDevice(addrs []net.Addr) (*ipDevice, error) {
 	ipdev := &ipDevice{}
 	for _, addr := range addrs {
 		ipaddrstr := addr.String()
-		if strings.Contains(ipaddrstr, ":") || strings.Contains(ipaddrstr, ".") {
+		// only the IPv4 address is used
+		if strings.Contains(ipaddrstr, ":") || !strings.Contains(ipaddrstr, ".") {
 			continue
 		}
 		ip, ipnet, err := net.ParseCIDR(ipaddrstr)
@@ -110,32 +102,58 @@ func getIPDevice(addrs []net.Addr) (*ipDevice, error) {
 	return ipdev, nil
 }
 
+// parseIPDevice parses the address with prefix length, e.g. 192.168.1.1/24
+func parseIPDevice(cidr string) (*ipDevice, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pase CIDR: %w", err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %s", cidr)
+	}
+	ipdev := &ipDevice{
+		address: IpAddress(byteToUint32(ip.To4())),
+		netmask: byteToUint32(ipnet.Mask),
+	}
+	ipdev.broadcast = IpAddress(uint32(ipdev.address) | (^ipdev.netmask))
+	return ipdev, nil
+}
+
 func (i IpAddress) String() string {
 	ipbyte := uint32ToBytes(uint32(i))
 	return fmt.Sprintf("%d.%d.%d.%d", ipbyte[0], ipbyte[1], ipbyte[2], ipbyte[3])
 }
 
-func ipInput(inputdev *netDevice, packet []byte) error {
-	if inputdev.ipdev.address == 0 {
+// parseIPHeader parses the fixed part of the IP header. The packet must be at least 20 bytes.
+func parseIPHeader(packet []byte) ipHeader {
+	v := ipv4View(packet)
+	return ipHeader{
+		version:        v.version(),
+		headerLen:      packet[0] & 0x0f,
+		tos:            v.tos(),
+		totalLen:       v.totalLen(),
+		identify:       v.identify(),
+		fragmentOffset: v.fragmentOffset(),
+		ttl:            v.ttl(),
+		protocol:       v.protocol(),
+		headerChecksum: v.headerChecksum(),
+		srcAddr:        v.srcAddr(),
+		destAddr:       v.destAddr(),
+	}
+}
+
+func ipInput(inputdev *netDevice, ethHeader ethernetHeader, pb *packetBuffer) error {
+	packet := pb.bytes()
+	if inputdev.ipdev().address == 0 {
+		dropPacket(inputdev, dropReasonIPNoAddress, packet)
 		return nil
 	}
 
 	if len(packet) < 20 {
+		dropPacket(inputdev, dropReasonIPTooShort, packet)
 		return fmt.Errorf("packet length is too short: name=%s", inputdev.name)
 	}
-	ipheader := ipHeader{
-		version:        packet[0] >> 4,
-		headerLen:      packet[0] << 5 >> 5,
-		tos:            packet[1],
-		totalLen:       byteToUint16(packet[2:4]),
-		identify:       byteToUint16(packet[4:6]),
-		fragmentOffset: byteToUint16(packet[6:8]),
-		ttl:            packet[8],
-		protocol:       packet[9],
-		headerChecksum: byteToUint16(packet[10:12]),
-		srcAddr:        IpAddress(byteToUint32(packet[12:16])),
-		destAddr:       IpAddress(byteToUint32(packet[16:20])),
-	}
+	ipheader := parseIPHeader(packet)
 
 	log.Printf("received IP in %s, packetType=%d, from=%s, to=%s",
 		inputdev.name,
@@ -144,86 +162,310 @@ func ipInput(inputdev *netDevice, packet []byte) error {
 		printIPAddr(uint32(ipheader.destAddr)),
 	)
 
-	macaddr, _ := searchArpTableEntry(ipheader.srcAddr)
-	if macaddr == [6]uint8{} {
-		addArpTableEntry(inputdev, ipheader.srcAddr, inputdev.etheHeader.srcAddr)
-	}
-
 	switch ipheader.version {
 	case 4:
 		break
 	case 6:
 		// TODO: implement
+		dropPacket(inputdev, dropReasonIPUnsupportedVersion, packet)
 		return fmt.Errorf("IPv6 is not supported")
 	default:
+		dropPacket(inputdev, dropReasonIPInvalidVersion, packet)
 		return fmt.Errorf("invalid IP version: %d", ipheader.version)
 	}
 
-	if ipheader.headerLen*4 > 20 {
-		return fmt.Errorf("IP header option is not supported")
+	headerLen := int(ipheader.headerLen) * 4
+	if headerLen < 20 || headerLen > len(packet) {
+		dropPacket(inputdev, dropReasonIPInvalidHeaderLength, packet)
+		return fmt.Errorf("invalid IP header length: %d", headerLen)
+	}
+	if calcChecksum(packet[:headerLen]) != 0 {
+		dropPacket(inputdev, dropReasonIPChecksumInvalid, packet)
+		return nil
+	}
+	if int(ipheader.totalLen) < headerLen || int(ipheader.totalLen) > len(packet) {
+		dropPacket(inputdev, dropReasonIPInvalidTotalLength, packet)
+		return fmt.Errorf("invalid IP total length: %d (received %d bytes)", ipheader.totalLen, len(packet))
+	}
+	// the padding of the link layer is not the payload
+	pb.trim(int(ipheader.totalLen))
+	packet = pb.bytes()
+
+	if ipMartianSource(inputdev, &ipheader) {
+		dropPacket(inputdev, dropReasonIPMartianSource, packet)
+		return nil
+	}
+	if ipMartianDestination(&ipheader) {
+		dropPacket(inputdev, dropReasonIPMartianDestination, packet)
+		return nil
+	}
+
+	// the inspected interfaces learn only from validated ARP packets
+	if arpLearnFromIP && !inputdev.arpInspection {
+		// only the unknown address is learned, the existing entry is kept
+		updateArpTableEntry(ipheader.srcAddr, func(entry *arpTableEntry, exists bool) bool {
+			if exists {
+				return false
+			}
+			entry.macAddr = ethHeader.srcAddr
+			entry.netdev = inputdev
+			return true
+		})
+	}
+	opts, pointer, err := parseIPOptions(packet[:headerLen])
+	if err != nil {
+		dropPacket(inputdev, dropReasonIPOptionInvalid, packet)
+		if err := icmpSendError(inputdev, &ipheader, packet, ICMP_TYPE_PARAM_PROBLEM, 0, uint32(pointer)<<24); err != nil {
+			log.Printf("%v", err)
+		}
+		return fmt.Errorf("invalid IP option: %w", err)
+	}
+	if opts.sourceRoute != 0 && !ipAcceptSourceRoute {
+		dropPacket(inputdev, dropReasonIPSourceRouted, packet)
+		return nil
+	}
+
+	metricIPProtocolInput.inc(ipProtocolName(ipheader.protocol))
+
+	if !urpfCheck(inputdev, &ipheader, packet) {
+		return nil
+	}
+	if !aclCheckIngress(inputdev, &ipheader, packet) {
+		return nil
+	}
+	if !firewallCheckIngress(inputdev, packet) {
+		return nil
+	}
+
+	// the source routed packet addressed to the router is forwarded to the next address of the route
+	if next, ok := ipSourceRouteNext(packet[:headerLen], opts); ok && ipLocalAddress(ipheader.destAddr) {
+		return ipSourceRouteForward(inputdev, ethHeader, &ipheader, opts, next, pb)
 	}
 
-	if ipheader.destAddr == IpAddressLimitedBroadcast || inputdev.ipdev.address == ipheader.destAddr {
+	if ipLocalDestination(ipheader.destAddr) {
 		// handle message as this post is destination
-		return ipInputToOurs(inputdev, &ipheader, packet[20:])
+		metricForwardDecision.inc("local")
+		return ipInputLocal(inputdev, &ipheader, pb)
+	}
+
+	// router alert asks the router to examine the packet not addressed to it, e.g. IGMP and RSVP.
+	// A copy is delivered locally and the packet is still forwarded (RFC 2113).
+	if opts.routerAlert != 0 {
+		metricForwardDecision.inc("local")
+		local := getPacketBuffer(packetBufferHeadroom, len(packet))
+		copy(local.append(len(packet)), packet)
+		localErr := ipInputLocal(inputdev, &ipheader, local)
+		local.free()
+		// the multicast is not routed, e.g. IGMP to the link-local groups
+		if uint32(ipheader.destAddr)>>28 == 0xe {
+			return localErr
+		}
+		if err := ipForward(inputdev, ethHeader, &ipheader, pb); err != nil {
+			return err
+		}
+		return localErr
 	}
 
+	return ipForward(inputdev, ethHeader, &ipheader, pb)
+}
+
+// ipLocalDestination returns true when the packet to the address is destined to the router,
+// which is the address or the broadcast address of one of the devices or the limited broadcast
+func ipLocalDestination(addr IpAddress) bool {
+	if addr == IpAddressLimitedBroadcast {
+		return true
+	}
 	for _, dev := range netDeviceList {
-		if dev.ipdev.address == IpAddress(ipheader.destAddr) || dev.ipdev.broadcast == ipheader.destAddr {
-			return ipInputToOurs(inputdev, &ipheader, packet[20:])
+		if ipdev := dev.ipdev(); ipdev.address == addr || ipdev.broadcast == addr {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil
+// ipLocalAddress returns true when the address is assigned to one of the devices
+func ipLocalAddress(addr IpAddress) bool {
+	for _, dev := range netDeviceList {
+		if dev.ipdev().address == addr {
+			return true
+		}
+	}
+	return false
 }
 
-func ipInputToOurs(inputdev *netDevice, ipheader *ipHeader, packet []byte) error {
+// ipMartianSource returns true for the source addresses which must not be received (RFC 1812 5.3.7)
+func ipMartianSource(inputdev *netDevice, ipheader *ipHeader) bool {
+	src := uint32(ipheader.srcAddr)
+	switch {
+	case src == 0:
+		// the unspecified source is only used for broadcast during initialization, e.g. DHCP
+		return ipheader.destAddr != IpAddressLimitedBroadcast
+	case src>>24 == 0, src>>24 == 127:
+		// this network and loopback
+		return true
+	case src>>28 == 0xe, src>>28 == 0xf:
+		// multicast, reserved and limited broadcast
+		return true
+	case ipheader.srcAddr == inputdev.ipdev().broadcast:
+		return true
+	}
+	return false
+}
+
+// ipMartianDestination returns true for the destination addresses which must not be received
+func ipMartianDestination(ipheader *ipHeader) bool {
+	dst := uint32(ipheader.destAddr)
+	switch {
+	case ipheader.destAddr == IpAddressLimitedBroadcast:
+		return false
+	case dst>>24 == 0, dst>>24 == 127, dst>>28 == 0xf:
+		return true
+	}
+	return false
+}
+
+// ipInputLocal reassembles the packet in pb destined to the router, and passes the payload
+// to ipInputToOurs after pulling the IP header
+func ipInputLocal(inputdev *netDevice, ipheader *ipHeader, pb *packetBuffer) error {
+	if isIPFragment(ipheader) {
+		packet := ipReassemble(inputdev, ipheader, pb.bytes())
+		if packet == nil {
+			return nil
+		}
+		reassembled := parseIPHeader(packet)
+		ipheader = &reassembled
+		// the reassembled datagram has no headroom, the reply moves it once
+		pb = wrapPacketBuffer(packet)
+		defer pb.free()
+	}
+	pb.pull(ipv4View(pb.bytes()).headerLen())
+	return ipInputToOurs(inputdev, ipheader, pb)
+}
+
+func ipInputToOurs(inputdev *netDevice, ipheader *ipHeader, pb *packetBuffer) error {
 	// TODO: implement NAT
+	packet := pb.bytes()
+
+	if !coppCheck(inputdev, coppClassify(ipheader, packet), packet) {
+		return nil
+	}
 
 	switch ipheader.protocol {
 	case IpProtocolNumICMP:
-		fmt.Println("ICMP received")
+		if len(packet) < ICMP_HEADER_LEN {
+			dropPacket(inputdev, dropReasonICMPTooShort, packet)
+			return nil
+		}
+		if icmpChecksum(packet) != 0 {
+			dropPacket(inputdev, dropReasonICMPChecksumInvalid, packet)
+			return nil
+		}
+		return icmpInput(inputdev, ipheader, pb)
 	case IpProtocolNumTCP:
+		if !transportChecksumValid(ipheader.srcAddr, ipheader.destAddr, ipheader.protocol, packet) {
+			dropPacket(inputdev, dropReasonTransportChecksumInvalid, packet)
+			return nil
+		}
 		fmt.Println("TCP received")
 	case IpProtocolNumUDP:
+		if !transportChecksumValid(ipheader.srcAddr, ipheader.destAddr, ipheader.protocol, packet) {
+			dropPacket(inputdev, dropReasonTransportChecksumInvalid, packet)
+			return nil
+		}
 		fmt.Println("UDP received")
+	case IpProtocolNumIGMP, IpProtocolNumRSVP:
+		// examined for router alert without a handler yet, counted by metricIPProtocolInput
 	default:
+		dropPacket(inputdev, dropReasonIPUnsupportedProtocol, packet)
 		return fmt.Errorf("Unsupported IP protocol: %d", ipheader.protocol)
 	}
 
 	return nil
 }
 
-// nolint: unused
-func ipPacketEncapsulateOutput(inputdev *netDevice, destAddr, srcAddr IpAddress, payload []byte, protocolType uint8) error {
-	var ipPacket []byte
+// ipRouteOutputDevice returns the device the packet to the address is sent from,
+// resolving the next hop of network routes by the connected routes.
+// It returns nil when there is no route.
+func ipRouteOutputDevice(addr IpAddress) *netDevice {
+	netdev, _ := ipRouteLookup(addr)
+	return netdev
+}
+
+// ipRouteLookup returns the device and the next hop the packet to the address is sent to.
+// The next hop is the address itself on the connected networks.
+// It returns nil when there is no route.
+func ipRouteLookup(addr IpAddress) (*netDevice, IpAddress) {
+	routes := iproute.Load()
+	route := routes.radixTreeSearch(uint32(addr))
+	switch route.iptype {
+	case IpRouteTypeConnected:
+		return route.netdev, addr
+	case IpRouteTypeNetwork:
+		if route.nexthop == 0 {
+			return nil, 0
+		}
+		nexthopRoute := routes.radixTreeSearch(route.nexthop)
+		if nexthopRoute.iptype != IpRouteTypeConnected {
+			return nil, 0
+		}
+		return nexthopRoute.netdev, IpAddress(route.nexthop)
+	}
+	return nil, 0
+}
+
+// ipPacketEncapsulateOutput prepends the IP header to the payload in pb and sends it to the next hop
+// of the route to destAddr. The source is the address of the output device when srcAddr is 0.
+func ipPacketEncapsulateOutput(destAddr, srcAddr IpAddress, pb *packetBuffer, protocolType uint8) error {
+	outputdev, nexthop := ipRouteLookup(destAddr)
+	if outputdev == nil {
+		return fmt.Errorf("no route to %s", destAddr)
+	}
+	// the address is not used until it is announced
+	if !acdAddressUsable(outputdev) {
+		outputdev.stats.txDropped.Add(1)
+		return nil
+	}
+	if srcAddr == 0 {
+		srcAddr = outputdev.ipdev().address
+	}
 
 	// IP header length (=20) + packet length
-	totalLength := 20 + len(payload)
+	totalLength := IP_HEADER_LEN + len(pb.bytes())
 
 	ipheader := ipHeader{
 		version:        4,
 		headerLen:      20 / 4,
 		tos:            0,
 		totalLen:       uint16(totalLength),
-		identify:       0xf80c,
-		fragmentOffset: 2 << 13,
+		identify:       nextIPIdentification(),
+		fragmentOffset: 0,
 		ttl:            0x40,
 		protocol:       protocolType,
 		headerChecksum: 0,
 		srcAddr:        srcAddr,
 		destAddr:       destAddr,
 	}
-	ipPacket = append(ipPacket, ipheader.ToPacket(true)...)
-	ipPacket = append(ipPacket, payload...)
+	// the headers are prepended in front of the payload in place
+	ipheader.encode(pb.prepend(IP_HEADER_LEN))
+	ipPacket := pb.bytes()
+	ipv4View(ipPacket).updateChecksum()
 
-	destMacAddr, _ := searchArpTableEntry(destAddr)
+	if !aclCheckEgress(outputdev, nil, ipPacket) {
+		return nil
+	}
+	firewallTrackEgress(ipPacket)
+
+	destMacAddr, _ := searchArpTableEntry(nexthop)
 	if destMacAddr != [6]uint8{0, 0, 0, 0, 0, 0} {
-		if err := ethernetOutput(inputdev, destMacAddr, ipPacket, ETHER_TYPE_IP); err != nil {
+		if err := ipOutputBuffer(outputdev, destMacAddr, pb); err != nil {
 			return err
 		}
 	} else {
-		if err := sendArpRequest(inputdev, destAddr); err != nil {
+		// the packet waits for the ARP reply
+		if err := arpQueuePending(outputdev, nil, nexthop, ipPacket); err != nil {
+			return err
+		}
+		if err := sendArpRequest(outputdev, nexthop); err != nil {
 			return err
 		}
 	}
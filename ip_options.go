@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	IP_OPTION_RECORD_ROUTE        uint8 = 7
+	IP_OPTION_TIMESTAMP           uint8 = 68
+	IP_OPTION_LOOSE_SOURCE_ROUTE  uint8 = 131
+	IP_OPTION_STRICT_SOURCE_ROUTE uint8 = 137
+	IP_OPTION_ROUTER_ALERT        uint8 = 148
+)
+
+// the flags of the timestamp option
+const (
+	IP_TIMESTAMP_ONLY         uint8 = 0
+	IP_TIMESTAMP_WITH_ADDRESS uint8 = 1
+	IP_TIMESTAMP_PRESPECIFIED uint8 = 3
+)
+
+// ipAcceptSourceRoute accepts the packets with the source route options, which are dropped by default
+var ipAcceptSourceRoute bool
+
+// ipOptions are the offsets of the options in the header, 0 if the option is absent
+type ipOptions struct {
+	recordRoute int
+	timestamp   int
+	sourceRoute int
+	routerAlert int
+}
+
+// parseIPOptions parses the options of the IP header.
+// On error it returns the offset of the invalid byte for ICMP parameter problem.
+func parseIPOptions(header []byte) (opts ipOptions, pointer int, err error) {
+	for offset := 20; offset < len(header); {
+		optionType := header[offset]
+		if optionType == IP_OPTION_END {
+			break
+		}
+		if optionType == IP_OPTION_NOP {
+			offset++
+			continue
+		}
+		if offset+1 >= len(header) {
+			return opts, offset, fmt.Errorf("option %d has no length", optionType)
+		}
+		optionLen := int(header[offset+1])
+		if optionLen < 2 || offset+optionLen > len(header) {
+			return opts, offset + 1, fmt.Errorf("invalid length of option %d: %d", optionType, optionLen)
+		}
+
+		switch optionType {
+		case IP_OPTION_RECORD_ROUTE, IP_OPTION_LOOSE_SOURCE_ROUTE, IP_OPTION_STRICT_SOURCE_ROUTE:
+			if optionLen < 3 || (optionLen-3)%4 != 0 {
+				return opts, offset + 1, fmt.Errorf("invalid length of option %d: %d", optionType, optionLen)
+			}
+			if ptr := int(header[offset+2]); ptr < 4 || ptr > optionLen+1 || (ptr-4)%4 != 0 {
+				return opts, offset + 2, fmt.Errorf("invalid pointer of option %d: %d", optionType, ptr)
+			}
+			if optionType == IP_OPTION_RECORD_ROUTE {
+				if opts.recordRoute != 0 {
+					return opts, offset, fmt.Errorf("duplicate record route option")
+				}
+				opts.recordRoute = offset
+			} else {
+				if opts.sourceRoute != 0 {
+					return opts, offset, fmt.Errorf("duplicate source route option")
+				}
+				opts.sourceRoute = offset
+			}
+		case IP_OPTION_TIMESTAMP:
+			if optionLen < 4 {
+				return opts, offset + 1, fmt.Errorf("invalid length of timestamp option: %d", optionLen)
+			}
+			entryLen := 4
+			switch flag := header[offset+3] & 0x0f; flag {
+			case IP_TIMESTAMP_ONLY:
+			case IP_TIMESTAMP_WITH_ADDRESS, IP_TIMESTAMP_PRESPECIFIED:
+				entryLen = 8
+			default:
+				return opts, offset + 3, fmt.Errorf("invalid flag of timestamp option: %d", flag)
+			}
+			if (optionLen-4)%entryLen != 0 {
+				return opts, offset + 1, fmt.Errorf("invalid length of timestamp option: %d", optionLen)
+			}
+			if ptr := int(header[offset+2]); ptr < 5 || ptr > optionLen+1 || (ptr-5)%entryLen != 0 {
+				return opts, offset + 2, fmt.Errorf("invalid pointer of timestamp option: %d", ptr)
+			}
+			opts.timestamp = offset
+		case IP_OPTION_ROUTER_ALERT:
+			if optionLen != 4 {
+				return opts, offset + 1, fmt.Errorf("invalid length of router alert option: %d", optionLen)
+			}
+			opts.routerAlert = offset
+		}
+		offset += optionLen
+	}
+	return opts, 0, nil
+}
+
+// ipSourceRouteNext returns the next address of the source route in the header,
+// or false when the route is exhausted
+func ipSourceRouteNext(header []byte, opts ipOptions) (IpAddress, bool) {
+	if opts.sourceRoute == 0 {
+		return 0, false
+	}
+	optionLen := int(header[opts.sourceRoute+1])
+	ptr := int(header[opts.sourceRoute+2])
+	if ptr > optionLen {
+		return 0, false
+	}
+	start := opts.sourceRoute + ptr - 1
+	return IpAddress(byteToUint32(header[start : start+4])), true
+}
+
+// ipTimestampNow returns the milliseconds since midnight UT (RFC 791)
+func ipTimestampNow() uint32 {
+	now := clock.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(now.Sub(midnight).Milliseconds())
+}
+
+// ipOptionsForward records outputdev in the record route and timestamp options
+// of the packet forwarded out of it, updating the header checksum
+func ipOptionsForward(outputdev *netDevice, packet []byte) error {
+	if ipv4View(packet).headerLen() <= IP_HEADER_LEN {
+		return nil
+	}
+	header := ipv4View(packet).header()
+	opts, _, err := parseIPOptions(header)
+	if err != nil {
+		return err
+	}
+	address := uint32ToBytes(uint32(outputdev.ipdev().address))
+
+	if opts.recordRoute != 0 {
+		optionLen := int(header[opts.recordRoute+1])
+		ptr := int(header[opts.recordRoute+2])
+		// the route is recorded while there is room
+		if ptr+3 <= optionLen {
+			copy(header[opts.recordRoute+ptr-1:], address)
+			header[opts.recordRoute+2] += 4
+		}
+	}
+
+	if opts.timestamp != 0 {
+		option := header[opts.timestamp:]
+		optionLen := int(option[1])
+		ptr := int(option[2])
+		flag := option[3] & 0x0f
+		timestamp := uint32ToBytes(ipTimestampNow())
+		switch {
+		case flag == IP_TIMESTAMP_ONLY && ptr+3 <= optionLen:
+			copy(option[ptr-1:], timestamp)
+			option[2] += 4
+		case flag == IP_TIMESTAMP_WITH_ADDRESS && ptr+7 <= optionLen:
+			copy(option[ptr-1:], address)
+			copy(option[ptr+3:], timestamp)
+			option[2] += 8
+		case flag == IP_TIMESTAMP_PRESPECIFIED && ptr+7 <= optionLen:
+			// only the prespecified router fills the timestamp
+			if byteToUint32(option[ptr-1:ptr+3]) == uint32(outputdev.ipdev().address) {
+				copy(option[ptr+3:], timestamp)
+				option[2] += 8
+			}
+		case ptr > optionLen:
+			// the overflow count in the upper 4 bits
+			if overflow := option[3] >> 4; overflow < 0x0f {
+				option[3] = (overflow+1)<<4 | flag
+			}
+		}
+	}
+
+	ipv4View(packet).updateChecksum()
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import "encoding/binary"
+
+// Header views read and write the fields in place of the packet buffer
+// without copying or allocating. The buffer must be long enough for the fixed header.
+
+const (
+	ETHERNET_HEADER_LEN = 14
+	IP_HEADER_LEN       = 20
+	ARP_PACKET_LEN      = 28
+	ICMP_HEADER_LEN     = 8
+)
+
+type ethernetView []byte
+
+func (v ethernetView) destAddr() [6]uint8     { return setMacAddr(v[0:6]) }
+func (v ethernetView) srcAddr() [6]uint8      { return setMacAddr(v[6:12]) }
+func (v ethernetView) etherType() uint16      { return binary.BigEndian.Uint16(v[12:14]) }
+func (v ethernetView) payload() []byte        { return v[ETHERNET_HEADER_LEN:] }
+func (v ethernetView) setDestAddr(a [6]uint8) { copy(v[0:6], a[:]) }
+func (v ethernetView) setSrcAddr(a [6]uint8)  { copy(v[6:12], a[:]) }
+func (v ethernetView) setEtherType(t uint16)  { binary.BigEndian.PutUint16(v[12:14], t) }
+
+type ipv4View []byte
+
+func (v ipv4View) version() uint8             { return v[0] >> 4 }
+func (v ipv4View) headerLen() int             { return int(v[0]&0x0f) * 4 }
+func (v ipv4View) tos() uint8                 { return v[1] }
+func (v ipv4View) totalLen() uint16           { return binary.BigEndian.Uint16(v[2:4]) }
+func (v ipv4View) identify() uint16           { return binary.BigEndian.Uint16(v[4:6]) }
+func (v ipv4View) fragmentOffset() uint16     { return binary.BigEndian.Uint16(v[6:8]) }
+func (v ipv4View) ttl() uint8                 { return v[8] }
+func (v ipv4View) protocol() uint8            { return v[9] }
+func (v ipv4View) headerChecksum() uint16     { return binary.BigEndian.Uint16(v[10:12]) }
+func (v ipv4View) srcAddr() IpAddress         { return IpAddress(binary.BigEndian.Uint32(v[12:16])) }
+func (v ipv4View) destAddr() IpAddress        { return IpAddress(binary.BigEndian.Uint32(v[16:20])) }
+func (v ipv4View) header() []byte             { return v[:v.headerLen()] }
+func (v ipv4View) payload() []byte            { return v[v.headerLen():] }
+func (v ipv4View) setTotalLen(n uint16)       { binary.BigEndian.PutUint16(v[2:4], n) }
+func (v ipv4View) setFragmentOffset(f uint16) { binary.BigEndian.PutUint16(v[6:8], f) }
+
+// updateChecksum recomputes the header checksum
+func (v ipv4View) updateChecksum() {
+	v[10], v[11] = 0, 0
+	binary.BigEndian.PutUint16(v[10:12], calcChecksum(v.header()))
+}
+
+// setTTL sets the TTL updating the checksum incrementally
+func (v ipv4View) setTTL(ttl uint8) {
+	old := binary.BigEndian.Uint16(v[8:10])
+	v[8] = ttl
+	binary.BigEndian.PutUint16(v[10:12], checksumUpdate16(v.headerChecksum(), old, binary.BigEndian.Uint16(v[8:10])))
+}
+
+type arpView []byte
+
+func (v arpView) hardwareType() uint16         { return binary.BigEndian.Uint16(v[0:2]) }
+func (v arpView) protocolType() uint16         { return binary.BigEndian.Uint16(v[2:4]) }
+func (v arpView) hardwareLen() uint8           { return v[4] }
+func (v arpView) protocolLen() uint8           { return v[5] }
+func (v arpView) opcode() uint16               { return binary.BigEndian.Uint16(v[6:8]) }
+func (v arpView) senderHardwareAddr() [6]uint8 { return setMacAddr(v[8:14]) }
+func (v arpView) senderIPAddr() IpAddress      { return IpAddress(binary.BigEndian.Uint32(v[14:18])) }
+func (v arpView) targetHardwareAddr() [6]uint8 { return setMacAddr(v[18:24]) }
+func (v arpView) targetIPAddr() IpAddress      { return IpAddress(binary.BigEndian.Uint32(v[24:28])) }
+
+// encode writes the header into b, which must be at least 14 bytes
+func (header ethernetHeader) encode(b []byte) {
+	v := ethernetView(b)
+	v.setDestAddr(header.destAddr)
+	v.setSrcAddr(header.srcAddr)
+	v.setEtherType(header.etherType)
+}
+
+// encode writes the fixed header into b, which must be at least 20 bytes
+func (i ipHeader) encode(b []byte) {
+	b[0] = i.version<<4 | i.headerLen
+	b[1] = i.tos
+	binary.BigEndian.PutUint16(b[2:4], i.totalLen)
+	binary.BigEndian.PutUint16(b[4:6], i.identify)
+	binary.BigEndian.PutUint16(b[6:8], i.fragmentOffset)
+	b[8] = i.ttl
+	b[9] = i.protocol
+	binary.BigEndian.PutUint16(b[10:12], i.headerChecksum)
+	binary.BigEndian.PutUint32(b[12:16], uint32(i.srcAddr))
+	binary.BigEndian.PutUint32(b[16:20], uint32(i.destAddr))
+}
+
+// encode writes the message into b, which must be at least 28 bytes
+func (msg arpIPToEthernet) encode(b []byte) {
+	binary.BigEndian.PutUint16(b[0:2], msg.hardwareType)
+	binary.BigEndian.PutUint16(b[2:4], msg.protocolType)
+	b[4] = msg.hardwareLen
+	b[5] = msg.protocolLen
+	binary.BigEndian.PutUint16(b[6:8], msg.opcode)
+	copy(b[8:14], msg.senderHardwareAddr[:])
+	binary.BigEndian.PutUint32(b[14:18], uint32(msg.senderIPAddr))
+	copy(b[18:24], msg.targetHardwareAddr[:])
+	binary.BigEndian.PutUint32(b[24:28], uint32(msg.targetIPAddr))
+}
+
+// encode writes the header into b, which must be at least 8 bytes
+func (h icmpHeader) encode(b []byte) {
+	b[0] = h.icmpType
+	b[1] = h.code
+	binary.BigEndian.PutUint16(b[2:4], h.checksum)
+	binary.BigEndian.PutUint32(b[4:8], h.rest)
+}
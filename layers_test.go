@@ -0,0 +1,106 @@
+package main
+
+import "testing"
+
+var (
+	testEthernetHeader = ethernetHeader{
+		destAddr:  [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+		srcAddr:   [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x02},
+		etherType: ETHER_TYPE_IP,
+	}
+	testIPHeader = ipHeader{
+		version:   4,
+		headerLen: 5,
+		totalLen:  84,
+		identify:  0x1234,
+		ttl:       64,
+		protocol:  IpProtocolNumICMP,
+		srcAddr:   0xc0a80102,
+		destAddr:  0xc0a80001,
+	}
+	testArpPacket = arpIPToEthernet{
+		hardwareType:       ARP_HTYPE_ETHERNET,
+		protocolType:       ETHER_TYPE_IP,
+		hardwareLen:        ETHERNET_ADDRESS_LEN,
+		protocolLen:        IpAddressLen,
+		opcode:             ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr: [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x02},
+		senderIPAddr:       0xc0a80102,
+		targetIPAddr:       0xc0a80101,
+	}
+)
+
+// the results are kept so that the parsing is not optimized away
+var (
+	benchEthernetHeader ethernetHeader
+	benchIPHeader       ipHeader
+	benchArpPacket      arpIPToEthernet
+)
+
+func TestLayersRoundTrip(t *testing.T) {
+	b := make([]byte, ARP_PACKET_LEN)
+	testEthernetHeader.encode(b)
+	if got := parseEthernetHeader(b); got != testEthernetHeader {
+		t.Errorf("ethernet header = %+v, want %+v", got, testEthernetHeader)
+	}
+	testIPHeader.encode(b)
+	if got := parseIPHeader(b); got != testIPHeader {
+		t.Errorf("IP header = %+v, want %+v", got, testIPHeader)
+	}
+	testArpPacket.encode(b)
+	if got := parseArpPacket(b); got != testArpPacket {
+		t.Errorf("ARP packet = %+v, want %+v", got, testArpPacket)
+	}
+}
+
+func BenchmarkParseEthernetHeader(b *testing.B) {
+	frame := make([]byte, ETHERNET_HEADER_LEN)
+	testEthernetHeader.encode(frame)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchEthernetHeader = parseEthernetHeader(frame)
+	}
+}
+
+func BenchmarkEncodeEthernetHeader(b *testing.B) {
+	frame := make([]byte, ETHERNET_HEADER_LEN)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		testEthernetHeader.encode(frame)
+	}
+}
+
+func BenchmarkParseIPHeader(b *testing.B) {
+	packet := make([]byte, IP_HEADER_LEN)
+	testIPHeader.encode(packet)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchIPHeader = parseIPHeader(packet)
+	}
+}
+
+func BenchmarkEncodeIPHeader(b *testing.B) {
+	packet := make([]byte, IP_HEADER_LEN)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		testIPHeader.encode(packet)
+		ipv4View(packet).updateChecksum()
+	}
+}
+
+func BenchmarkParseArpPacket(b *testing.B) {
+	packet := make([]byte, ARP_PACKET_LEN)
+	testArpPacket.encode(packet)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchArpPacket = parseArpPacket(packet)
+	}
+}
+
+func BenchmarkEncodeArpPacket(b *testing.B) {
+	packet := make([]byte, ARP_PACKET_LEN)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		testArpPacket.encode(packet)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownAnnounce sends gratuitous ARP on every device before shutting down
+var shutdownAnnounce bool
+
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+// shutdownHooks are run in order after the shutdown announcements while the sockets are still open
+var shutdownHooks []shutdownHook
+
+// registerShutdownHook registers the function called on graceful shutdown
+func registerShutdownHook(name string, fn func() error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// watchShutdownSignal returns a file descriptor which becomes readable
+// when SIGINT or SIGTERM is received, so that it can be monitored by epoll.
+func watchShutdownSignal() (int, error) {
+	fds := make([]int, 2)
+	if err := syscall.Pipe2(fds, syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return -1, fmt.Errorf("failed to create pipe: %w", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		// a second signal terminates the process immediately
+		signal.Stop(sigCh)
+		log.Printf("Received %v, shutting down", sig)
+		if _, err := syscall.Write(fds[1], []byte{byte(sig.(syscall.Signal))}); err != nil {
+			log.Printf("failed to notify shutdown: %v", err)
+		}
+		if err := syscall.Close(fds[1]); err != nil {
+			log.Printf("failed to close signal pipe: %v", err)
+		}
+	}()
+
+	return fds[0], nil
+}
+
+// routerShutdown releases all resources of the router and returns the exit status
+func routerShutdown(epfd, sigfd int) int {
+	status := 0
+
+	// the announcements are sent before the hooks stop the capture, so that they are recorded
+	if shutdownAnnounce {
+		for _, netdev := range netDeviceList {
+			if netdev.socket < 0 || netdev.ipdev().address == 0 || !acdAddressUsable(netdev) {
+				continue
+			}
+			if err := sendGratuitousArp(netdev); err != nil {
+				log.Printf("failed to announce %s: %v", netdev.name, err)
+			}
+			if err := netdev.netDeviceFlush(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+
+	// the packets waiting for ARP replies are dropped by a hook
+	for _, hook := range shutdownHooks {
+		if err := hook.fn(); err != nil {
+			log.Printf("failed to run shutdown hook %s: %v", hook.name, err)
+			status = 1
+		}
+	}
+
+	for _, netdev := range netDeviceList {
+		if err := netdev.netDeviceClose(); err != nil {
+			log.Printf("%v", err)
+			status = 1
+		}
+	}
+	if err := syscall.Close(sigfd); err != nil {
+		log.Printf("failed to close signal pipe: %v", err)
+		status = 1
+	}
+	if err := syscall.Close(epfd); err != nil {
+		log.Printf("failed to close epoll: %v", err)
+		status = 1
+	}
+
+	log.Printf("Shutdown completed")
+	return status
+}
@@ -5,6 +5,72 @@ import "flag"
 func main() {
 	var mode string
 	flag.StringVar(&mode, "mode", "ch1", "set run router mode")
+	flag.StringVar(&metricsListenAddr, "metrics-addr", "", "listen address of the Prometheus metrics and runtime control endpoint (e.g. :9100)")
+	flag.Uint64Var(&dropLogSampleRate, "drop-log-sample", 0, "log a hexdump of one of every N dropped packets (0 disables)")
+	flag.BoolVar(&shutdownAnnounce, "shutdown-announce", false, "send gratuitous ARP on every interface before shutting down")
+	flag.StringVar(&captureOptions.path, "capture-file", "", "write received and transmitted frames to the pcapng file")
+	flag.Func("capture-interfaces", "comma separated interfaces to capture (default all)", func(s string) error {
+		captureOptions.interfaces = parseInterfaceList(s)
+		return nil
+	})
+	flag.Func("capture-filter", "filter expression of the captured frames (e.g. \"arp or udp port 53\")", func(s string) (err error) {
+		captureOptions.filter, err = compilePacketFilter(s)
+		return err
+	})
+	flag.Func("log-filter", "filter expression of the frames dumped to the log in ch1 mode", func(s string) (err error) {
+		debugLogFilter, err = compilePacketFilter(s)
+		return err
+	})
+	flag.StringVar(&captureDir, "capture-dir", "", "directory the captures started by POST /capture/start are written to (empty disables it)")
+	flag.Int64Var(&captureOptions.fileSize, "capture-file-size", 0, "rotate the capture file when it exceeds the bytes (0 disables rotation)")
+	flag.IntVar(&captureOptions.fileCount, "capture-file-count", 0, "the number of rotated capture files kept as a ring (0 keeps all)")
+	flag.Func("mirror", "mirror session as name=N;sources=IF,...;direction=rx|tx|both;destination=IF;truncate=N;filter=EXPR (repeatable)", func(s string) error {
+		mirrorOptions = append(mirrorOptions, s)
+		return nil
+	})
+	flag.StringVar(&aclFile, "acl-file", "", "file of the access control lists attached to the interfaces")
+	flag.Func("firewall-outside", "comma separated interfaces new connections cannot be initiated from (enables connection tracking)", func(s string) error {
+		firewallOutsideInterfaces = parseInterfaceList(s)
+		return nil
+	})
+	flag.IntVar(&conntrackMaxEntries, "conntrack-max", conntrackMaxEntries, "the maximum number of tracked connections")
+	flag.StringVar(&urpfOptions, "urpf", "", "uRPF modes of the interfaces as IF=strict|loose,...")
+	flag.Func("copp", "control-plane policers as CLASS=RATE[/BURST],... in packets per second (classes: arp, icmp, routing, management, other; 0 disables)", parseCoPPOptions)
+	flag.Func("icmp-error-rate", "rate limit of the generated ICMP errors as RATE[/BURST] in packets per second (0 disables)", func(s string) (err error) {
+		icmpErrorLimiter, err = parseRateBurst(s)
+		return
+	})
+	flag.Func("arp-inspection", "comma separated interfaces whose ARP senders are validated against the bindings", func(s string) error {
+		arpInspectionInterfaces = parseInterfaceList(s)
+		return nil
+	})
+	flag.StringVar(&arpBindingFile, "arp-binding-file", "", "file of the static ARP bindings as <interface> <address> <macaddr> per line")
+	flag.StringVar(&arpLeaseFile, "arp-lease-file", "", "dnsmasq DHCP lease file the ARP bindings are loaded from")
+	flag.BoolVar(&arpLearnFromIP, "arp-learn-from-ip", arpLearnFromIP, "learn the ARP cache from the source of received IP packets")
+	flag.DurationVar(&arpConfirmHold, "arp-confirm-hold", arpConfirmHold, "how long the MAC address of a confirmed ARP entry cannot be changed")
+	flag.Func("proxy-arp", "comma separated interfaces which answer ARP requests for the addresses routed via other interfaces (requires -ip-forward)", func(s string) error {
+		proxyArpInterfaces = parseInterfaceList(s)
+		return nil
+	})
+	flag.BoolVar(&acdProbe, "acd", false, "probe the interface addresses for conflicts when they are set, and announce them before using them (RFC 5227)")
+	flag.BoolVar(&acdDefend, "acd-defend", false, "defend the interface addresses against conflicting ARP packets")
+	flag.BoolVar(&packetRingEnabled, "packet-ring", true, "receive and transmit with TPACKET_V3 memory mapped rings on the AF_PACKET sockets, falling back to a syscall per frame")
+	flag.Func("xdp", "comma separated interfaces which receive and transmit with AF_XDP sockets in generic XDP mode, falling back to AF_PACKET", func(s string) error {
+		xdpInterfaces = parseInterfaceList(s)
+		return nil
+	})
+	flag.IntVar(&packetWorkers, "workers", packetWorkers, "the number of workers receiving the frames spread by PACKET_FANOUT (0 runs one per CPU)")
+	flag.StringVar(&mtuOptions, "mtu", "", "MTU overrides of the interfaces as IF=MTU,... (default read from the kernel)")
+	flag.IntVar(&ipReassemblyMemory, "reassembly-memory", ipReassemblyMemory, "the maximum bytes of the fragments waiting for reassembly")
+	flag.BoolVar(&ipForwarding, "ip-forward", false, "route the received packets not destined to the router to the next hop")
+	flag.BoolVar(&ipAcceptSourceRoute, "ip-accept-source-route", false, "accept the packets with the loose or strict source route option")
+	flag.StringVar(&replayOptions.input, "pcap", "", "pcap or pcapng file replayed in replay mode")
+	flag.StringVar(&replayOptions.ingress, "ingress", "", "the interface the replayed frames are received on")
+	flag.StringVar(&replayOptions.output, "pcap-out", "", "pcapng file the frames transmitted in replay mode are written to")
+	flag.Func("replay-device", "virtual device in replay mode as name=macaddr,address/prefix (repeatable)", func(s string) error {
+		replayOptions.devices = append(replayOptions.devices, s)
+		return nil
+	})
 	flag.Parse()
 
 	switch mode {
@@ -12,6 +78,8 @@ func main() {
 		runChapter1()
 	case "ch2":
 		runChapter2()
+	case "replay":
+		runReplay()
 	default:
 	}
 }
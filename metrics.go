@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricsListenAddr is the address of the Prometheus endpoint. Empty disables it.
+// The runtime control handlers are served on the same address.
+var metricsListenAddr string
+
+// httpHandlers are served in addition to /metrics
+var httpHandlers = map[string]http.HandlerFunc{}
+
+// registerHTTPHandler registers the handler served with the metrics
+func registerHTTPHandler(pattern string, handler http.HandlerFunc) {
+	httpHandlers[pattern] = handler
+}
+
+// metricCollector writes metrics in the Prometheus text exposition format
+type metricCollector interface {
+	writeMetrics(w io.Writer)
+}
+
+var metricsRegistry []metricCollector
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	v           atomic.Uint64
+}
+
+// gauge is a single value which can go up and down
+type gauge struct {
+	name string
+	help string
+	v    atomic.Int64
+}
+
+var (
+	metricEtherTypeInput = newCounterVec(
+		"curo_ethernet_input_packets_total",
+		"Number of received frames for this router by ether type.",
+		"ethertype",
+	)
+	metricIPProtocolInput = newCounterVec(
+		"curo_ip_input_packets_total",
+		"Number of received IP packets by protocol.",
+		"protocol",
+	)
+	metricArpPackets = newCounterVec(
+		"curo_arp_packets_total",
+		"Number of ARP packets by direction and operation.",
+		"direction", "operation",
+	)
+	metricForwardDecision = newCounterVec(
+		"curo_ip_forward_decisions_total",
+		"Number of forwarding decisions made for received IP packets.",
+		"decision",
+	)
+	metricArpCacheEntries = newGauge(
+		"curo_arp_cache_entries",
+		"Number of entries in the ARP table.",
+	)
+	metricRoutes = newGauge(
+		"curo_routes",
+		"Number of entries in the routing table.",
+	)
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry,
+		netDeviceCollector{},
+		metricEtherTypeInput,
+		metricIPProtocolInput,
+		metricArpPackets,
+		metricForwardDecision,
+		metricArpCacheEntries,
+		metricRoutes,
+	)
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+}
+
+// add adds delta to the counter identified by labelValues
+func (c *counterVec) add(delta uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		c.values[key] = value
+	}
+	c.mu.Unlock()
+
+	value.v.Add(delta)
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*counterValue, 0, len(keys))
+	for _, key := range keys {
+		values = append(values, c.values[key])
+	}
+	c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, value.labelValues), value.v.Load())
+	}
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) set(v int) {
+	g.v.Store(int64(v))
+}
+
+func (g *gauge) inc() {
+	g.v.Add(1)
+}
+
+func (g *gauge) dec() {
+	g.v.Add(-1)
+}
+
+func (g *gauge) writeMetrics(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+}
+
+// netDeviceCollector exports the statistics of each netDevice
+type netDeviceCollector struct{}
+
+func (netDeviceCollector) writeMetrics(w io.Writer) {
+	stats := []struct {
+		name  string
+		help  string
+		value func(s *netDeviceStats) uint64
+	}{
+		{"curo_netdev_rx_packets_total", "Number of received frames.", func(s *netDeviceStats) uint64 { return s.rxPackets.Load() }},
+		{"curo_netdev_rx_bytes_total", "Number of received bytes.", func(s *netDeviceStats) uint64 { return s.rxBytes.Load() }},
+		{"curo_netdev_rx_errors_total", "Number of receive errors.", func(s *netDeviceStats) uint64 { return s.rxErrors.Load() }},
+		{"curo_netdev_rx_dropped_total", "Number of received frames which were discarded.", func(s *netDeviceStats) uint64 { return s.rxDropped.Load() }},
+		{"curo_netdev_tx_packets_total", "Number of transmitted frames.", func(s *netDeviceStats) uint64 { return s.txPackets.Load() }},
+		{"curo_netdev_tx_bytes_total", "Number of transmitted bytes.", func(s *netDeviceStats) uint64 { return s.txBytes.Load() }},
+		{"curo_netdev_tx_errors_total", "Number of transmit errors.", func(s *netDeviceStats) uint64 { return s.txErrors.Load() }},
+		{"curo_netdev_tx_dropped_total", "Number of frames which could not be transmitted.", func(s *netDeviceStats) uint64 { return s.txDropped.Load() }},
+	}
+
+	for _, stat := range stats {
+		writeMetricHeader(w, stat.name, stat.help, "counter")
+		for _, netdev := range netDeviceList {
+			fmt.Fprintf(w, "%s%s %d\n", stat.name, formatLabels([]string{"device"}, []string{netdev.name}), stat.value(&netdev.stats))
+		}
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, collector := range metricsRegistry {
+		collector.writeMetrics(w)
+	}
+}
+
+// startMetricsServer serves the metrics on /metrics in the background
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	for pattern, handler := range httpHandlers {
+		mux.HandleFunc(pattern, handler)
+	}
+
+	log.Printf("Serving metrics on %s/metrics", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("failed to serve metrics: %v", err)
+		}
+	}()
+}
+
+func etherTypeName(etherType uint16) string {
+	switch etherType {
+	case ETHER_TYPE_IP:
+		return "ipv4"
+	case ETHER_TYPE_ARP:
+		return "arp"
+	case ETHER_TYPE_IPV6:
+		return "ipv6"
+	default:
+		return fmt.Sprintf("0x%04x", etherType)
+	}
+}
+
+func ipProtocolName(protocol uint8) string {
+	switch protocol {
+	case IpProtocolNumICMP:
+		return "icmp"
+	case IpProtocolNumTCP:
+		return "tcp"
+	case IpProtocolNumUDP:
+		return "udp"
+	case IpProtocolNumIGMP:
+		return "igmp"
+	case IpProtocolNumRSVP:
+		return "rsvp"
+	case IpProtocolNumOSPF:
+		return "ospf"
+	default:
+		return fmt.Sprintf("%d", protocol)
+	}
+}
+
+func arpOperationName(opcode uint16) string {
+	switch opcode {
+	case ARP_OPERATION_CODE_REQUEST:
+		return "request"
+	case ARP_OPERATION_CODE_REPLY:
+		return "reply"
+	default:
+		return fmt.Sprintf("%d", opcode)
+	}
+}
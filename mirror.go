@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// mirrorOptions are the mirror sessions given on the command line, e.g.
+//
+//	name=dns;sources=router1-host1,router1-router2;direction=both;destination=router1-analyzer;truncate=128;filter=udp port 53
+var mirrorOptions []string
+
+// mirrorSession copies the frames of the source devices to the destination device
+type mirrorSession struct {
+	name        string
+	sources     []string
+	ingress     bool
+	egress      bool
+	destination *netDevice
+	// the frames are truncated to the length. 0 copies the whole frame.
+	truncate int
+	filter   *packetFilter
+}
+
+var (
+	// mirror sessions by the source device
+	mirrorIngressSessions = map[*netDevice][]*mirrorSession{}
+	mirrorEgressSessions  = map[*netDevice][]*mirrorSession{}
+)
+
+var metricMirrorPackets = newCounterVec(
+	"curo_mirror_packets_total",
+	"Number of frames copied by mirror sessions.",
+	"session",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricMirrorPackets)
+}
+
+// setupMirrorSessions creates the sessions of mirrorOptions for the devices in netDeviceList
+func setupMirrorSessions() error {
+	var sessions []*mirrorSession
+	for i, spec := range mirrorOptions {
+		session, err := parseMirrorSession(spec)
+		if err != nil {
+			return fmt.Errorf("invalid mirror session %q: %w", spec, err)
+		}
+		if session.name == "" {
+			session.name = fmt.Sprintf("mirror%d", i)
+		}
+		sessions = append(sessions, session)
+	}
+
+	// a destination cannot be a source, so that mirrored frames are never mirrored again
+	destinations := map[*netDevice]struct{}{}
+	for _, session := range sessions {
+		destinations[session.destination] = struct{}{}
+	}
+
+	for _, session := range sessions {
+		for _, name := range session.sources {
+			netdev := lookupNetDevice(name)
+			if netdev == nil {
+				return fmt.Errorf("source device %s of mirror session %s is not found", name, session.name)
+			}
+			if _, ok := destinations[netdev]; ok {
+				return fmt.Errorf("device %s is a mirror destination and cannot be a source", name)
+			}
+			if session.ingress {
+				mirrorIngressSessions[netdev] = append(mirrorIngressSessions[netdev], session)
+			}
+			if session.egress {
+				mirrorEgressSessions[netdev] = append(mirrorEgressSessions[netdev], session)
+			}
+		}
+		log.Printf("Set mirror session %s from %s to %s",
+			session.name, strings.Join(session.sources, ","), session.destination.name,
+		)
+	}
+	return nil
+}
+
+func parseMirrorSession(spec string) (*mirrorSession, error) {
+	session := &mirrorSession{ingress: true, egress: true}
+
+	for _, param := range strings.Split(spec, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, fmt.Errorf("expected key=value: %s", param)
+		}
+		switch key {
+		case "name":
+			session.name = value
+		case "sources":
+			session.sources = parseInterfaceList(value)
+		case "direction":
+			switch value {
+			case "rx", "ingress":
+				session.ingress, session.egress = true, false
+			case "tx", "egress":
+				session.ingress, session.egress = false, true
+			case "both":
+				session.ingress, session.egress = true, true
+			default:
+				return nil, fmt.Errorf("unknown direction: %s", value)
+			}
+		case "destination":
+			session.destination = lookupNetDevice(value)
+			if session.destination == nil {
+				return nil, fmt.Errorf("destination device %s is not found", value)
+			}
+		case "truncate":
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("invalid truncate length: %s", value)
+			}
+			session.truncate = v
+		case "filter":
+			filter, err := compilePacketFilter(value)
+			if err != nil {
+				return nil, err
+			}
+			session.filter = filter
+		default:
+			return nil, fmt.Errorf("unknown parameter: %s", key)
+		}
+	}
+
+	if len(session.sources) == 0 || session.destination == nil {
+		return nil, fmt.Errorf("sources and destination are required")
+	}
+	return session, nil
+}
+
+// mirrorFrame copies the frame received or transmitted on netdev to the mirror destinations
+func mirrorFrame(netdev *netDevice, data []byte, direction captureDirection) {
+	sessions := mirrorIngressSessions[netdev]
+	if direction == captureDirectionOutbound {
+		sessions = mirrorEgressSessions[netdev]
+	}
+
+	for _, session := range sessions {
+		if !session.filter.match(data) {
+			continue
+		}
+		frame := data
+		if session.truncate > 0 && len(frame) > session.truncate {
+			frame = frame[:session.truncate]
+		}
+		if err := session.destination.netDeviceTransmit(frame); err != nil {
+			log.Printf("failed to mirror frame of %s to %s: %v", netdev.name, session.destination.name, err)
+			continue
+		}
+		metricMirrorPackets.inc(session.name)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -14,21 +19,104 @@ var IGNORE_INTERFACES = map[string]struct{}{
 }
 
 type netDevice struct {
-	name       string
-	macaddr    [6]uint8
-	socket     int
-	sockaddr   syscall.SockaddrLinklayer
-	etheHeader ethernetHeader
-	ipdev      ipDevice
+	name     string
+	macaddr  [6]uint8
+	socket   int
+	sockaddr syscall.SockaddrLinklayer
+	// the address, replaced as a whole when it changes while the workers read it
+	ipdevice atomic.Pointer[ipDevice]
+	mtu      int
+	stats    netDeviceStats
+	// the memory mapped rings of the socket, nil when a syscall is used per frame
+	ring *packetRing
+	// the AF_XDP socket receiving and transmitting instead of the AF_PACKET socket, nil if not used
+	xsk *xdpSocket
+	// serializes the transmission of the workers on the socket, the TX ring and the AF_XDP socket
+	txMu sync.Mutex
+	// the sockets of the workers other than worker 0 in the fanout group of the socket
+	queues []*netQueue
+	// virtual devices have no socket and their frames are only seen by the capture
+	virtual bool
+	// new connections cannot be initiated from the outside of the firewall
+	firewallOutside bool
+	// unicast reverse path forwarding check of the received packets
+	urpf urpfMode
+	// validate ARP senders against the bindings
+	arpInspection bool
+	// answer ARP requests for the addresses routed via other interfaces
+	proxyArp bool
 }
 
-func (netdev netDevice) netDeviceTransmit(data []byte) error {
+// ipdev returns the address of netdev, which is zero when not set
+func (netdev *netDevice) ipdev() ipDevice {
+	if ipdev := netdev.ipdevice.Load(); ipdev != nil {
+		return *ipdev
+	}
+	return ipDevice{}
+}
+
+// debugLogFilter selects the frames dumped in ch1 mode. nil selects everything.
+var debugLogFilter *packetFilter
+
+// netDeviceStats holds the traffic counters of netDevice
+type netDeviceStats struct {
+	rxPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	rxErrors  atomic.Uint64
+	rxDropped atomic.Uint64
+	txPackets atomic.Uint64
+	txBytes   atomic.Uint64
+	txErrors  atomic.Uint64
+	txDropped atomic.Uint64
+}
+
+func (netdev *netDevice) netDeviceTransmit(data []byte) error {
+	captureFrame(netdev, data, captureDirectionOutbound)
+	mirrorFrame(netdev, data, captureDirectionOutbound)
+	if netdev.virtual {
+		netdev.stats.txPackets.Add(1)
+		netdev.stats.txBytes.Add(uint64(len(data)))
+		return nil
+	}
+	netdev.txMu.Lock()
+	defer netdev.txMu.Unlock()
+	if netdev.xsk != nil {
+		if err := netdev.xsk.transmit(data); err != nil {
+			netdev.stats.txErrors.Add(1)
+			return fmt.Errorf("failed to transmit netDevice: %w", err)
+		}
+		netdev.stats.txPackets.Add(1)
+		netdev.stats.txBytes.Add(uint64(len(data)))
+		return nil
+	}
+	if netdev.ring != nil {
+		if err := netdev.ring.transmit(data); err != nil {
+			netdev.stats.txErrors.Add(1)
+			return fmt.Errorf("failed to transmit netDevice: %w", err)
+		}
+		netdev.stats.txPackets.Add(1)
+		netdev.stats.txBytes.Add(uint64(len(data)))
+		return nil
+	}
 	if err := syscall.Sendto(netdev.socket, data, 0, &netdev.sockaddr); err != nil {
+		netdev.stats.txErrors.Add(1)
 		return fmt.Errorf("failed to transmit netDevice: %w", err)
 	}
+	netdev.stats.txPackets.Add(1)
+	netdev.stats.txBytes.Add(uint64(len(data)))
 	return nil
 }
 
+// maxFrameLen returns the length of the largest frame received on netdev,
+// which is the MTU with the ethernet header and a VLAN tag
+func (netdev *netDevice) maxFrameLen() int {
+	mtu := netdev.mtu
+	if mtu == 0 {
+		mtu = IpDefaultMTU
+	}
+	return ETHERNET_HEADER_LEN + ETHERNET_VLAN_TAG_LEN + mtu
+}
+
 // isIgnoreInterfaces returns true when the name of the interface should be ignored.
 func isIgnoreInterfaces(name string) bool {
 	_, ok := IGNORE_INTERFACES[name]
@@ -40,25 +128,205 @@ func htons(i uint16) uint16 {
 	return (i<<8)&0xff00 | i>>8
 }
 
+var metricPacketHandlerPanics = newCounterVec(
+	"curo_packet_handler_panics_total",
+	"Number of panics recovered while processing a received packet.",
+	"device",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricPacketHandlerPanics)
+}
+
+// packetError is an error which only affects the packet being processed.
+// The netDevice can continue to receive after it.
+type packetError struct {
+	err error
+}
+
+func (e *packetError) Error() string {
+	return e.err.Error()
+}
+
+func (e *packetError) Unwrap() error {
+	return e.err
+}
+
+// isPacketError returns true when the error is limited to a single packet
+func isPacketError(err error) bool {
+	var perr *packetError
+	return errors.As(err, &perr)
+}
+
+// isTransientSocketError returns true when the error of the socket is expected to clear,
+// such as the link going down or the kernel running out of buffers
+func isTransientSocketError(err error) bool {
+	return errors.Is(err, syscall.ENETDOWN) || errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM)
+}
+
+// netDeviceSocketError reads and clears the pending error of socket. The rings never
+// receive the error, so epoll would report it on every wait until it is read.
+func (netdev *netDevice) netDeviceSocketError(socket int) error {
+	errno, err := syscall.GetsockoptInt(socket, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return fmt.Errorf("failed to get socket error, device = %s: %w", netdev.name, err)
+	}
+	if errno == 0 {
+		return nil
+	}
+	netdev.stats.rxErrors.Add(1)
+	err = fmt.Errorf("socket error, device = %s: %w", netdev.name, syscall.Errno(errno))
+	if isTransientSocketError(err) {
+		return &packetError{err: err}
+	}
+	return err
+}
+
 func (netdev *netDevice) netDevicePoll(mode string) error {
-	recvbuffer := make([]byte, 1500)
+	return netdev.netDevicePollSocket(mode, netdev.socket, netdev.ring, 0)
+}
 
-	n, _, err := syscall.Recvfrom(netdev.socket, recvbuffer, 0)
+// netDevicePollSocket processes the frames received on socket of netdev, which is the
+// primary socket or a queue. ring is the rings of the socket or nil, and revents is
+// the epoll events of the socket.
+func (netdev *netDevice) netDevicePollSocket(mode string, socket int, ring *packetRing, revents uint32) error {
+	if ring != nil {
+		if revents&syscall.EPOLLERR != 0 {
+			if err := netdev.netDeviceSocketError(socket); err != nil {
+				return err
+			}
+		}
+		return ring.receive(func(frame []byte, length int) error {
+			pb := wrapPacketBuffer(frame)
+			defer pb.free()
+			return netdev.netDeviceReceive(mode, pb, length)
+		})
+	}
+
+	frameLen := netdev.maxFrameLen()
+	pb := getPacketBuffer(packetBufferHeadroom, frameLen)
+	defer pb.free()
+	recvbuffer := pb.append(frameLen)
+
+	// MSG_TRUNC returns the length of the frame even when it exceeds the buffer
+	n, _, err := syscall.Recvfrom(socket, recvbuffer, syscall.MSG_TRUNC)
 	if err != nil {
-		if n == -1 {
+		if err == syscall.EAGAIN || err == syscall.EINTR {
 			return nil
 		}
-		return fmt.Errorf("failed to receive, n = %d, device = %s: %v", n, netdev.name, err)
+		netdev.stats.rxErrors.Add(1)
+		err = fmt.Errorf("failed to receive, device = %s: %w", netdev.name, err)
+		if isTransientSocketError(err) {
+			return &packetError{err: err}
+		}
+		return err
+	}
+
+	if n <= frameLen {
+		pb.trim(n)
+	}
+	return netdev.netDeviceReceive(mode, pb, n)
+}
+
+// netDevicePollXDP processes the frames received on the AF_XDP socket
+func (netdev *netDevice) netDevicePollXDP(mode string) error {
+	return netdev.xsk.receive(func(frame []byte, length int) error {
+		pb := wrapPacketBuffer(frame)
+		defer pb.free()
+		return netdev.netDeviceReceive(mode, pb, length)
+	})
+}
+
+// netDeviceReceive processes the frame received on netdev in pb. length is the length
+// on the wire, which exceeds the frame when it was truncated.
+func (netdev *netDevice) netDeviceReceive(mode string, pb *packetBuffer, length int) error {
+	frame := pb.bytes()
+	netdev.stats.rxPackets.Add(1)
+	netdev.stats.rxBytes.Add(uint64(length))
+	if length > len(frame) || length > netdev.maxFrameLen() {
+		dropPacket(netdev, dropReasonFrameTooLong, frame)
+		return nil
 	}
+	captureFrame(netdev, frame, captureDirectionInbound)
+	mirrorFrame(netdev, frame, captureDirectionInbound)
 
 	switch mode {
 	case "ch1":
-		fmt.Printf("Received %d bytes from %s: %x\n", n, netdev.name, recvbuffer[:n])
+		if !debugLogFilter.match(frame) {
+			return nil
+		}
+		fmt.Printf("Received %d bytes from %s: %x\n", len(frame), netdev.name, frame)
 	default:
-		if err := ethernetInput(netdev, recvbuffer[:n]); err != nil {
-			return err
+		// the discarded packets are counted by dropPacket, rxErrors counts only the receive failures
+		if err := netdev.netDeviceInput(pb); err != nil {
+			return &packetError{err: err}
 		}
 	}
 
 	return nil
 }
+
+// netDeviceFlush sends the frames queued in the TX ring of netdev
+func (netdev *netDevice) netDeviceFlush() error {
+	netdev.txMu.Lock()
+	defer netdev.txMu.Unlock()
+	var err error
+	switch {
+	case netdev.xsk != nil:
+		err = netdev.xsk.flush()
+	case netdev.ring != nil:
+		err = netdev.ring.flush()
+	}
+	if err != nil {
+		netdev.stats.txErrors.Add(1)
+		return fmt.Errorf("failed to flush %s: %w", netdev.name, err)
+	}
+	return nil
+}
+
+// netDeviceInput passes the received frame in pb to ethernetInput.
+// A panic in the protocol handlers is recovered, dropping the packet, and returned as an error.
+func (netdev *netDevice) netDeviceInput(pb *packetBuffer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metricPacketHandlerPanics.inc(netdev.name)
+			dropPacket(netdev, dropReasonHandlerPanic, pb.bytes())
+			log.Printf("recovered from panic while processing packet on %s: %v\n%s", netdev.name, r, debug.Stack())
+			err = fmt.Errorf("panic while processing packet: %v", r)
+		}
+	}()
+
+	return ethernetInput(netdev, pb)
+}
+
+// netDeviceClose closes the sockets of netDevice. The workers must be stopped.
+func (netdev *netDevice) netDeviceClose() error {
+	netdev.closeQueues()
+	return netdev.netDeviceClosePrimary()
+}
+
+// netDeviceClosePrimary closes the primary socket and the AF_XDP socket of netDevice
+func (netdev *netDevice) netDeviceClosePrimary() error {
+	netdev.txMu.Lock()
+	defer netdev.txMu.Unlock()
+	if netdev.socket < 0 {
+		return nil
+	}
+	if netdev.xsk != nil {
+		if err := netdev.xsk.close(); err != nil {
+			log.Printf("failed to close AF_XDP socket of %s: %v", netdev.name, err)
+		}
+		netdev.xsk = nil
+	}
+	if netdev.ring != nil {
+		if err := netdev.ring.close(); err != nil {
+			log.Printf("failed to close rings of %s: %v", netdev.name, err)
+		}
+		netdev.ring = nil
+	}
+	if err := syscall.Close(netdev.socket); err != nil {
+		return fmt.Errorf("failed to close socket of %s: %w", netdev.name, err)
+	}
+	netdev.socket = -1
+	return nil
+}
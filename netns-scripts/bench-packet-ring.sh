@@ -0,0 +1,68 @@
+#!/bin/bash
+
+# Compares the TPACKET_V3 rings with a syscall per frame.
+# The frames sent into bench_r-h are mirrored out of bench_r-h2 by the router,
+# and the received, mirrored frames and the CPU time of the router are printed.
+# usage: bench-packet-ring.sh [count]
+
+set -eu
+
+# check privileges
+if [ $UID -ne 0 ]; then
+  echo "Root privilege is required"
+  exit 1;
+fi
+
+COUNT=${1:-1000000}
+cd "$(dirname "$0")"
+
+go build -o /tmp/curo-bench ..
+go build -o /tmp/blast-bench blast.go
+
+cleanup() {
+  ip netns delete bench_h 2>/dev/null || true
+  ip netns delete bench_r 2>/dev/null || true
+}
+trap cleanup EXIT
+cleanup
+
+ip netns add bench_h
+ip netns add bench_r
+ip link add name bench_h-r type veth peer name bench_r-h
+ip link add name bench_h-r2 type veth peer name bench_r-h2
+ip link set bench_h-r netns bench_h
+ip link set bench_h-r2 netns bench_h
+ip link set bench_r-h netns bench_r
+ip link set bench_r-h2 netns bench_r
+for dev in bench_h-r bench_h-r2; do
+  ip netns exec bench_h ip link set $dev arp off up
+done
+for dev in bench_r-h bench_r-h2; do
+  ip netns exec bench_r ip link set $dev arp off up
+done
+ip netns exec bench_r ip link set lo up
+
+bench() {
+  local option=$1 size=$2
+  ip netns exec bench_r /tmp/curo-bench -mode ch2 $option -metrics-addr 127.0.0.1:9100 \
+    "-mirror=name=bench;sources=bench_r-h;direction=rx;destination=bench_r-h2" > /tmp/curo-bench.log 2>&1 &
+  local pid=$!
+  sleep 1
+  local sent
+  sent=$(ip netns exec bench_h /tmp/blast-bench bench_h-r "$COUNT" "$size")
+  sleep 1
+  local counters
+  counters=$(ip netns exec bench_r curl -s 127.0.0.1:9100/metrics |
+    grep -E '^curo_netdev_(rx_packets_total\{device="bench_r-h"|tx_packets_total\{device="bench_r-h2")' |
+    awk '{print $2}' | tr '\n' ' ')
+  local cpu
+  cpu=$(awk '{print ($14+$15)/100}' /proc/$pid/stat)
+  echo "$option size=$size: $sent, received/mirrored: $counters cpu: ${cpu}s"
+  kill -INT $pid
+  wait $pid || true
+}
+
+for size in 64 1514; do
+  bench -packet-ring=false $size
+  bench -packet-ring=true $size
+done
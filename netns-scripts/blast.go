@@ -0,0 +1,57 @@
+//go:build ignore
+
+// blast sends the same ethernet frame out of an interface as fast as possible.
+// usage: go run blast.go <interface> <count> <size>
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if len(os.Args) != 4 {
+		log.Fatalf("usage: %s <interface> <count> <size>", os.Args[0])
+	}
+	ifi, err := net.InterfaceByName(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	count, err := strconv.Atoi(os.Args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+	size, err := strconv.Atoi(os.Args[3])
+	if err != nil || size < 14 {
+		log.Fatalf("invalid size: %s", os.Args[3])
+	}
+
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addr := &syscall.SockaddrLinklayer{Ifindex: ifi.Index}
+	if err := syscall.Bind(sock, addr); err != nil {
+		log.Fatal(err)
+	}
+
+	// IPv4 frame to a MAC address nobody owns, so that the router only receives it
+	frame := make([]byte, size)
+	copy(frame, []byte{0x02, 0, 0, 0, 0, 0x99, 0x02, 0, 0, 0, 0xaa, 0x01, 0x08, 0x00})
+
+	start := time.Now()
+	for sent := 0; sent < count; {
+		// ENOBUFS is retried when the queue of the interface is full
+		if err := syscall.Sendto(sock, frame, 0, addr); err != nil {
+			continue
+		}
+		sent++
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("sent %d frames in %v (%.0f pps)\n", count, elapsed, float64(count)/elapsed.Seconds())
+}
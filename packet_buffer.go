@@ -0,0 +1,106 @@
+package main
+
+import "sync"
+
+const (
+	// packetBufferHeadroom is reserved in front of the received frames
+	// so that the headers of the encapsulation can be prepended in place
+	packetBufferHeadroom = 64
+	// the VLAN tag may follow the source address of the received frame
+	ETHERNET_VLAN_TAG_LEN = 4
+)
+
+// packetBuffer holds a received frame or a packet built from the payload toward the link layer.
+// The headers are prepended into the headroom and the data appended into the tailroom
+// without copying the rest of the packet.
+type packetBuffer struct {
+	buf  []byte
+	head int
+	tail int
+	// buf is not owned by the buffer, e.g. the memory of a ring, and is not kept by the pool
+	borrowed bool
+}
+
+var packetBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &packetBuffer{}
+	},
+}
+
+// getPacketBuffer returns the empty buffer from the pool which has headroom bytes
+// before and at least size bytes of tailroom after the start of the data.
+// The buffer is returned to the pool by free.
+func getPacketBuffer(headroom, size int) *packetBuffer {
+	pb := packetBufferPool.Get().(*packetBuffer)
+	if cap(pb.buf) < headroom+size {
+		pb.buf = make([]byte, headroom+size)
+	}
+	pb.buf = pb.buf[:cap(pb.buf)]
+	pb.head = headroom
+	pb.tail = headroom
+	return pb
+}
+
+// wrapPacketBuffer returns the buffer holding the frame in place, e.g. in the memory mapped ring.
+// It has no headroom until the headers are pulled, so prepending more moves the data once.
+// The frame is not kept by the pool after free.
+func wrapPacketBuffer(frame []byte) *packetBuffer {
+	pb := packetBufferPool.Get().(*packetBuffer)
+	pb.buf = frame[:len(frame):len(frame)]
+	pb.head = 0
+	pb.tail = len(frame)
+	pb.borrowed = true
+	return pb
+}
+
+// free returns pb to the pool. The data must not be referenced after it.
+func (pb *packetBuffer) free() {
+	if pb.borrowed {
+		pb.buf = nil
+		pb.borrowed = false
+	}
+	packetBufferPool.Put(pb)
+}
+
+// prepend extends the data by n bytes at the front and returns them
+func (pb *packetBuffer) prepend(n int) []byte {
+	if pb.head < n {
+		// the headroom was too small, the data is moved once
+		buf := make([]byte, n+len(pb.buf)-pb.head)
+		copy(buf[n:], pb.buf[pb.head:pb.tail])
+		pb.tail = n + pb.tail - pb.head
+		pb.head = n
+		pb.buf = buf
+		pb.borrowed = false
+	}
+	pb.head -= n
+	return pb.buf[pb.head : pb.head+n]
+}
+
+// append extends the data by n bytes at the end and returns them
+func (pb *packetBuffer) append(n int) []byte {
+	if pb.tail+n > len(pb.buf) {
+		buf := make([]byte, pb.tail+n)
+		copy(buf, pb.buf[:pb.tail])
+		pb.buf = buf
+		pb.borrowed = false
+	}
+	pb.tail += n
+	return pb.buf[pb.tail-n : pb.tail]
+}
+
+// pull removes n bytes from the front of the data, which become headroom, and returns them
+func (pb *packetBuffer) pull(n int) []byte {
+	pb.head += n
+	return pb.buf[pb.head-n : pb.head]
+}
+
+// trim shortens the data to n bytes
+func (pb *packetBuffer) trim(n int) {
+	pb.tail = pb.head + n
+}
+
+// bytes returns the data
+func (pb *packetBuffer) bytes() []byte {
+	return pb.buf[pb.head:pb.tail]
+}
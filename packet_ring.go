@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// TPACKET_V3 memory mapped rings of the AF_PACKET socket (Documentation/networking/packet_mmap.rst).
+// The kernel fills the received frames into the blocks of the RX ring, which are processed
+// together per wakeup. The transmitted frames are queued in the TX ring and sent by one syscall.
+
+const (
+	PACKET_VERSION = 10
+	PACKET_TX_RING = 13
+	PACKET_LOSS    = 14
+	TPACKET_V3     = 2
+
+	TP_STATUS_KERNEL       uint32 = 0
+	TP_STATUS_USER         uint32 = 1
+	TP_STATUS_AVAILABLE    uint32 = 0
+	TP_STATUS_SEND_REQUEST uint32 = 1
+	TP_STATUS_WRONG_FORMAT uint32 = 4
+
+	// TPACKET_ALIGN(sizeof(struct tpacket3_hdr)), the offset of the transmitted frame
+	TPACKET3_HDRLEN   = 48
+	TPACKET_ALIGNMENT = 16
+)
+
+const (
+	// the block size must be a multiple of the page size
+	packetRingBlockSize = 1 << 18
+	packetRxRingBlocks  = 16
+	packetTxRingBlocks  = 4
+	// the RX ring frame size of TPACKET_V3 only bounds tp_frame_nr, the frames are variable
+	packetRxRingFrameSize = 2048
+	// the block is passed to us after this many milliseconds even when it is not full
+	packetRingRetireTimeout = 2
+	// the queued frames are sent when this many are pending
+	packetTxBatchSize = 64
+)
+
+// packetRingEnabled uses the rings on the AF_PACKET sockets instead of one syscall per frame
+var packetRingEnabled = true
+
+var errTxRingFull = errors.New("TX ring is full")
+
+// struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type packetRing struct {
+	socket int
+	mem    []byte
+	rx     []byte
+	// the index of the next block of the RX ring
+	rxBlock int
+
+	tx               []byte
+	txFrameSize      int
+	txFramesPerBlock int
+	txFrameNr        int
+	// the index of the next frame of the TX ring
+	txHead    int
+	txPending int
+}
+
+// setupPacketRings sets up the rings on the sockets of the devices in netDeviceList.
+// The devices whose rings cannot be set up use a syscall per frame.
+func setupPacketRings() {
+	if !packetRingEnabled {
+		return
+	}
+	for _, netdev := range netDeviceList {
+		if netdev.virtual || netdev.socket < 0 {
+			continue
+		}
+		ring, err := newPacketRing(netdev.socket, netdev.maxFrameLen())
+		if err != nil {
+			log.Printf("failed to set up packet rings on %s, falling back to a syscall per frame: %v", netdev.name, err)
+			continue
+		}
+		netdev.ring = ring
+		log.Printf("Set up TPACKET_V3 rings on %s", netdev.name)
+	}
+}
+
+func setsockoptTpacketReq3(socket, opt int, req *tpacketReq3) error {
+	return setsockopt(socket, syscall.SOL_PACKET, opt, unsafe.Pointer(req), unsafe.Sizeof(*req))
+}
+
+// newPacketRing sets up the RX and TX rings for the frames up to frameLen bytes on socket
+func newPacketRing(socket, frameLen int) (*packetRing, error) {
+	if err := syscall.SetsockoptInt(socket, syscall.SOL_PACKET, PACKET_VERSION, TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("failed to set TPACKET_V3: %w", err)
+	}
+	// the frames in wrong format are skipped instead of stopping the TX ring
+	if err := syscall.SetsockoptInt(socket, syscall.SOL_PACKET, PACKET_LOSS, 1); err != nil {
+		return nil, fmt.Errorf("failed to set PACKET_LOSS: %w", err)
+	}
+
+	rxReq := tpacketReq3{
+		blockSize:    packetRingBlockSize,
+		blockNr:      packetRxRingBlocks,
+		frameSize:    packetRxRingFrameSize,
+		frameNr:      packetRingBlockSize / packetRxRingFrameSize * packetRxRingBlocks,
+		retireBlkTov: packetRingRetireTimeout,
+	}
+	if err := setsockoptTpacketReq3(socket, syscall.PACKET_RX_RING, &rxReq); err != nil {
+		return nil, fmt.Errorf("failed to set up RX ring: %w", err)
+	}
+
+	r := &packetRing{
+		socket:      socket,
+		txFrameSize: (TPACKET3_HDRLEN + frameLen + TPACKET_ALIGNMENT - 1) &^ (TPACKET_ALIGNMENT - 1),
+	}
+	r.txFramesPerBlock = packetRingBlockSize / r.txFrameSize
+	r.txFrameNr = r.txFramesPerBlock * packetTxRingBlocks
+	txReq := tpacketReq3{
+		blockSize: packetRingBlockSize,
+		blockNr:   packetTxRingBlocks,
+		frameSize: uint32(r.txFrameSize),
+		frameNr:   uint32(r.txFrameNr),
+	}
+	if err := setsockoptTpacketReq3(socket, PACKET_TX_RING, &txReq); err != nil {
+		r.teardown()
+		return nil, fmt.Errorf("failed to set up TX ring: %w", err)
+	}
+
+	// the TX ring follows the RX ring in the mapping
+	rxSize := packetRingBlockSize * packetRxRingBlocks
+	txSize := packetRingBlockSize * packetTxRingBlocks
+	mem, err := syscall.Mmap(socket, 0, rxSize+txSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		r.teardown()
+		return nil, fmt.Errorf("failed to map rings: %w", err)
+	}
+	r.mem = mem
+	r.rx = mem[:rxSize]
+	r.tx = mem[rxSize:]
+	return r, nil
+}
+
+// teardown releases the rings not yet mapped so that the socket can be used by syscalls
+func (r *packetRing) teardown() {
+	var req tpacketReq3
+	if err := setsockoptTpacketReq3(r.socket, syscall.PACKET_RX_RING, &req); err != nil {
+		log.Printf("failed to release RX ring: %v", err)
+	}
+	if err := setsockoptTpacketReq3(r.socket, PACKET_TX_RING, &req); err != nil {
+		log.Printf("failed to release TX ring: %v", err)
+	}
+	if err := syscall.SetsockoptInt(r.socket, syscall.SOL_PACKET, PACKET_VERSION, 0); err != nil {
+		log.Printf("failed to reset TPACKET version: %v", err)
+	}
+}
+
+// ringUint32 loads the 32-bit field in host byte order shared with the kernel
+func ringUint32(b []byte, offset int) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&b[offset])))
+}
+
+func ringStoreUint32(b []byte, offset int, v uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&b[offset])), v)
+}
+
+// receive calls handle with the frames of the blocks passed to us and returns the blocks
+// to the kernel. length is the length of the frame on the wire. The frames must not be
+// referenced after handle returns. The first error of handle is returned after the batch.
+func (r *packetRing) receive(handle func(frame []byte, length int) error) error {
+	var firstErr error
+	for i := 0; i < packetRxRingBlocks; i++ {
+		block := r.rx[r.rxBlock*packetRingBlockSize : (r.rxBlock+1)*packetRingBlockSize]
+		// struct tpacket_block_desc: block_status, num_pkts and offset_to_first_pkt of hdr.bh1
+		if ringUint32(block, 8)&TP_STATUS_USER == 0 {
+			break
+		}
+		numPkts := int(ringUint32(block, 12))
+		offset := int(ringUint32(block, 16))
+		for n := 0; n < numPkts; n++ {
+			// struct tpacket3_hdr
+			hdr := block[offset:]
+			snaplen := int(ringUint32(hdr, 12))
+			length := int(ringUint32(hdr, 16))
+			mac := int(*(*uint16)(unsafe.Pointer(&hdr[24])))
+			if err := handle(hdr[mac:mac+snaplen], length); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			offset += int(ringUint32(hdr, 0))
+		}
+		ringStoreUint32(block, 8, TP_STATUS_KERNEL)
+		r.rxBlock = (r.rxBlock + 1) % packetRxRingBlocks
+	}
+	return firstErr
+}
+
+// txFrame returns the frame of the TX ring at index
+func (r *packetRing) txFrame(index int) []byte {
+	offset := index/r.txFramesPerBlock*packetRingBlockSize + index%r.txFramesPerBlock*r.txFrameSize
+	return r.tx[offset : offset+r.txFrameSize]
+}
+
+// transmit copies data into the TX ring. The frames are sent by flush
+// or when a batch is pending.
+func (r *packetRing) transmit(data []byte) error {
+	if len(data) > r.txFrameSize-TPACKET3_HDRLEN {
+		return fmt.Errorf("frame of %d bytes exceeds the TX ring frame", len(data))
+	}
+	frame := r.txFrame(r.txHead)
+	// struct tpacket3_hdr: tp_status
+	if status := ringUint32(frame, 20); status != TP_STATUS_AVAILABLE && status != TP_STATUS_WRONG_FORMAT {
+		// the frame queued one lap before has not been sent yet
+		if err := r.flush(); err != nil {
+			return err
+		}
+		if status := ringUint32(frame, 20); status != TP_STATUS_AVAILABLE && status != TP_STATUS_WRONG_FORMAT {
+			return errTxRingFull
+		}
+	}
+
+	copy(frame[TPACKET3_HDRLEN:], data)
+	// tp_next_offset must be 0 and tp_len is the length of the frame
+	ringStoreUint32(frame, 0, 0)
+	ringStoreUint32(frame, 16, uint32(len(data)))
+	ringStoreUint32(frame, 20, TP_STATUS_SEND_REQUEST)
+	r.txHead = (r.txHead + 1) % r.txFrameNr
+	r.txPending++
+
+	if r.txPending >= packetTxBatchSize {
+		return r.flush()
+	}
+	return nil
+}
+
+// flush sends the frames queued in the TX ring
+func (r *packetRing) flush() error {
+	if r.txPending == 0 {
+		return nil
+	}
+	r.txPending = 0
+	for {
+		// the empty write sends the frames of the TX ring
+		_, err := syscall.Write(r.socket, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send TX ring: %w", err)
+		}
+		return nil
+	}
+}
+
+// close sends the pending frames and unmaps the rings
+func (r *packetRing) close() error {
+	err := r.flush()
+	if r.mem != nil {
+		if uerr := syscall.Munmap(r.mem); uerr != nil && err == nil {
+			err = fmt.Errorf("failed to unmap rings: %w", uerr)
+		}
+		r.mem, r.rx, r.tx = nil, nil, nil
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	PCAP_MAGIC_MICROSECONDS uint32 = 0xa1b2c3d4
+	PCAP_MAGIC_NANOSECONDS  uint32 = 0xa1b23c4d
+	PCAP_LINKTYPE_ETHERNET  uint32 = 1
+
+	PCAPNG_BLOCK_TYPE_SPB uint32 = 0x00000003
+)
+
+// pcapRecord is a frame read from a pcap or pcapng file
+type pcapRecord struct {
+	timestamp time.Time
+	data      []byte
+	// the interface the frame was captured on, if recorded
+	iface     *pcapInterface
+	direction captureDirection
+}
+
+// pcapInterface is an interface described in a pcapng file
+type pcapInterface struct {
+	name        string
+	macaddr     []byte
+	description string
+	linkType    uint16
+	// timestamp units per second
+	tsresol uint64
+}
+
+// readPcapFile reads all frames of a pcap or pcapng file
+func readPcapFile(path string) ([]pcapRecord, []*pcapInterface, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read pcap file: %w", err)
+	}
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("invalid pcap file: length is too short (length=%d)", len(b))
+	}
+
+	if binary.LittleEndian.Uint32(b[0:4]) == PCAPNG_BLOCK_TYPE_SHB {
+		return parsePcapng(b)
+	}
+	records, err := parsePcap(b)
+	return records, nil, err
+}
+
+// parsePcap parses the classic libpcap format
+func parsePcap(b []byte) ([]pcapRecord, error) {
+	if len(b) < 24 {
+		return nil, fmt.Errorf("invalid pcap file: global header is too short")
+	}
+
+	var order binary.ByteOrder
+	var nanosecond bool
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch o.Uint32(b[0:4]) {
+		case PCAP_MAGIC_MICROSECONDS:
+			order = o
+		case PCAP_MAGIC_NANOSECONDS:
+			order = o
+			nanosecond = true
+		}
+		if order != nil {
+			break
+		}
+	}
+	if order == nil {
+		return nil, fmt.Errorf("invalid pcap file: unknown magic number 0x%x", b[0:4])
+	}
+	if linkType := order.Uint32(b[20:24]); linkType != PCAP_LINKTYPE_ETHERNET {
+		return nil, fmt.Errorf("unsupported link type: %d", linkType)
+	}
+
+	var records []pcapRecord
+	for offset := 24; offset < len(b); {
+		if len(b) < offset+16 {
+			return nil, fmt.Errorf("invalid pcap file: record header is truncated at %d", offset)
+		}
+		sec := int64(order.Uint32(b[offset : offset+4]))
+		frac := int64(order.Uint32(b[offset+4 : offset+8]))
+		capLen := int(order.Uint32(b[offset+8 : offset+12]))
+		offset += 16
+		// the length from the file may be negative as int on 32-bit platforms
+		if capLen < 0 || len(b)-offset < capLen {
+			return nil, fmt.Errorf("invalid pcap file: record is truncated at %d", offset)
+		}
+
+		if !nanosecond {
+			frac *= 1000
+		}
+		records = append(records, pcapRecord{
+			timestamp: time.Unix(sec, frac),
+			data:      b[offset : offset+capLen],
+		})
+		offset += capLen
+	}
+	return records, nil
+}
+
+// parsePcapng parses the pcapng format.
+// Only enhanced and simple packet blocks on ethernet interfaces are read.
+func parsePcapng(b []byte) ([]pcapRecord, []*pcapInterface, error) {
+	var records []pcapRecord
+	var allInterfaces []*pcapInterface
+	var interfaces []*pcapInterface
+	var order binary.ByteOrder = binary.LittleEndian
+
+	for offset := 0; offset < len(b); {
+		if len(b) < offset+12 {
+			return nil, nil, fmt.Errorf("invalid pcapng file: block is truncated at %d", offset)
+		}
+		blockType := order.Uint32(b[offset : offset+4])
+		if blockType == PCAPNG_BLOCK_TYPE_SHB {
+			// the byte order and the interfaces are defined per section
+			if binary.BigEndian.Uint32(b[offset+8:offset+12]) == PCAPNG_BYTE_ORDER_MAGIC {
+				order = binary.BigEndian
+			} else {
+				order = binary.LittleEndian
+			}
+			interfaces = nil
+		}
+		totalLen := int(order.Uint32(b[offset+4 : offset+8]))
+		if totalLen < 12 || len(b) < offset+totalLen {
+			return nil, nil, fmt.Errorf("invalid pcapng file: invalid block length %d at %d", totalLen, offset)
+		}
+		body := b[offset+8 : offset+totalLen-4]
+		offset += totalLen
+
+		switch blockType {
+		case PCAPNG_BLOCK_TYPE_IDB:
+			if len(body) < 8 {
+				return nil, nil, fmt.Errorf("invalid pcapng file: interface description block is too short")
+			}
+			iface := &pcapInterface{
+				linkType: order.Uint16(body[0:2]),
+				tsresol:  1000000,
+			}
+			for _, opt := range parsePcapngOptions(order, body[8:]) {
+				switch opt.code {
+				case PCAPNG_OPT_IF_NAME:
+					iface.name = string(opt.value)
+				case PCAPNG_OPT_IF_DESCR:
+					iface.description = string(opt.value)
+				case PCAPNG_OPT_IF_MACADDR:
+					iface.macaddr = opt.value
+				case PCAPNG_OPT_IF_TSRESOL:
+					if len(opt.value) > 0 {
+						tsresol, err := pcapngTimestampResolution(opt.value[0])
+						if err != nil {
+							return nil, nil, fmt.Errorf("invalid pcapng file: %w", err)
+						}
+						iface.tsresol = tsresol
+					}
+				}
+			}
+			interfaces = append(interfaces, iface)
+			allInterfaces = append(allInterfaces, iface)
+		case PCAPNG_BLOCK_TYPE_EPB:
+			if len(body) < 20 {
+				return nil, nil, fmt.Errorf("invalid pcapng file: enhanced packet block is too short")
+			}
+			id := int(order.Uint32(body[0:4]))
+			if id >= len(interfaces) {
+				return nil, nil, fmt.Errorf("invalid pcapng file: unknown interface id %d", id)
+			}
+			iface := interfaces[id]
+			ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+			capLen := int(order.Uint32(body[12:16]))
+			if capLen < 0 || len(body)-20 < capLen {
+				return nil, nil, fmt.Errorf("invalid pcapng file: enhanced packet block is truncated")
+			}
+			record := pcapRecord{
+				timestamp: time.Unix(int64(ts/iface.tsresol), int64(ts%iface.tsresol*1000000000/iface.tsresol)),
+				data:      body[20 : 20+capLen],
+				iface:     iface,
+			}
+			optOffset := 20 + capLen + (4-capLen%4)%4
+			if optOffset < len(body) {
+				for _, opt := range parsePcapngOptions(order, body[optOffset:]) {
+					if opt.code == PCAPNG_OPT_EPB_FLAGS && len(opt.value) == 4 {
+						record.direction = captureDirection(order.Uint32(opt.value) & 0x03)
+					}
+				}
+			}
+			if iface.linkType == PCAPNG_LINKTYPE_ETHERNET {
+				records = append(records, record)
+			}
+		case PCAPNG_BLOCK_TYPE_SPB:
+			if len(body) < 4 || len(interfaces) == 0 {
+				return nil, nil, fmt.Errorf("invalid pcapng file: invalid simple packet block")
+			}
+			capLen := int(order.Uint32(body[0:4]))
+			if capLen < 0 || capLen > len(body)-4 {
+				capLen = len(body) - 4
+			}
+			if interfaces[0].linkType == PCAPNG_LINKTYPE_ETHERNET {
+				records = append(records, pcapRecord{
+					data:  body[4 : 4+capLen],
+					iface: interfaces[0],
+				})
+			}
+		}
+	}
+	return records, allInterfaces, nil
+}
+
+func parsePcapngOptions(order binary.ByteOrder, b []byte) (options []pcapngOption) {
+	for offset := 0; offset+4 <= len(b); {
+		code := order.Uint16(b[offset : offset+2])
+		length := int(order.Uint16(b[offset+2 : offset+4]))
+		offset += 4
+		if code == PCAPNG_OPT_ENDOFOPT || offset+length > len(b) {
+			break
+		}
+		options = append(options, pcapngOption{code: code, value: b[offset : offset+length]})
+		offset += length + (4-length%4)%4
+	}
+	return options
+}
+
+const (
+	// the finest if_tsresol accepted, so that the fraction of a second in nanoseconds does not overflow
+	pcapngMaxTsresolDecimal = 9
+	pcapngMaxTsresolBinary  = 30
+)
+
+// pcapngTimestampResolution converts if_tsresol to units per second
+func pcapngTimestampResolution(v uint8) (uint64, error) {
+	if v&0x80 != 0 {
+		exp := v & 0x7f
+		if exp > pcapngMaxTsresolBinary {
+			return 0, fmt.Errorf("unsupported timestamp resolution 2^-%d", exp)
+		}
+		return uint64(1) << exp, nil
+	}
+	if v > pcapngMaxTsresolDecimal {
+		return 0, fmt.Errorf("unsupported timestamp resolution 10^-%d", v)
+	}
+	resol := uint64(1)
+	for i := uint8(0); i < v; i++ {
+		resol *= 10
+	}
+	return resol, nil
+}
+
+// ipDevice returns the address recorded in the interface description, e.g. 192.168.1.1/24
+func (iface *pcapInterface) ipDevice() (*ipDevice, error) {
+	return parseIPDevice(iface.description)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// testPcapng returns a pcapng file with one frame on an interface whose if_tsresol is tsresol
+func testPcapng(t testing.TB, tsresol uint8) []byte {
+	var buf bytes.Buffer
+	w, err := newPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netdev := &netDevice{name: "r1", macaddr: [6]uint8{0x02, 0, 0, 0, 0, 0x01}}
+	frame := make([]byte, 60)
+	if err := w.writePacket(netdev, time.Unix(1700000000, 123456789), frame, captureDirectionInbound); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	// the if_tsresol option written as code 9, length 1 and the value 9
+	opt := []byte{byte(PCAPNG_OPT_IF_TSRESOL), 0, 1, 0, 9}
+	i := bytes.Index(b, opt)
+	if i < 0 {
+		t.Fatal("if_tsresol option is not found")
+	}
+	b[i+len(opt)-1] = tsresol
+	return b
+}
+
+func TestParsePcapngTimestampResolution(t *testing.T) {
+	tests := []struct {
+		tsresol uint8
+		want    time.Time
+		wantErr bool
+	}{
+		{tsresol: 9, want: time.Unix(1700000000, 123456789)},
+		{tsresol: 0x80 | 30, want: time.Unix(0, 0).Add(time.Duration(1700000000123456789/(1<<30)) * time.Second)},
+		{tsresol: 10, wantErr: true},
+		{tsresol: 20, wantErr: true},
+		{tsresol: 0x80 | 31, wantErr: true},
+		{tsresol: 0x80 | 64, wantErr: true},
+		{tsresol: 0xff, wantErr: true},
+	}
+	for _, tt := range tests {
+		records, _, err := parsePcapng(testPcapng(t, tt.tsresol))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("tsresol 0x%02x: expected an error", tt.tsresol)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tsresol 0x%02x: %v", tt.tsresol, err)
+			continue
+		}
+		if len(records) != 1 || records[0].timestamp.Unix() != tt.want.Unix() {
+			t.Errorf("tsresol 0x%02x: got %v, want %v", tt.tsresol, records, tt.want)
+		}
+	}
+}
+
+func FuzzParsePcapng(f *testing.F) {
+	f.Add(testPcapng(f, 9))
+	f.Add(testPcapng(f, 0x80|64))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// malformed files must fail without panicking
+		_, _, _ = parsePcapng(b)
+	})
+}
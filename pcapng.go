@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// pcapng block types and options (draft-ietf-opsawg-pcapng)
+const (
+	PCAPNG_BLOCK_TYPE_SHB uint32 = 0x0a0d0d0a
+	PCAPNG_BLOCK_TYPE_IDB uint32 = 0x00000001
+	PCAPNG_BLOCK_TYPE_EPB uint32 = 0x00000006
+
+	PCAPNG_BYTE_ORDER_MAGIC  uint32 = 0x1a2b3c4d
+	PCAPNG_LINKTYPE_ETHERNET uint16 = 1
+
+	PCAPNG_OPT_ENDOFOPT   uint16 = 0
+	PCAPNG_OPT_IF_NAME    uint16 = 2
+	PCAPNG_OPT_IF_DESCR   uint16 = 3
+	PCAPNG_OPT_IF_MACADDR uint16 = 6
+	PCAPNG_OPT_IF_TSRESOL uint16 = 9
+	PCAPNG_OPT_EPB_FLAGS  uint16 = 2
+)
+
+// captureDirection is the direction of the frame seen from the router
+type captureDirection uint8
+
+const (
+	captureDirectionUnknown captureDirection = iota
+	captureDirectionInbound
+	captureDirectionOutbound
+)
+
+// pcapngWriter writes frames in the pcapng format.
+// Interface description blocks are written when an interface is first used.
+type pcapngWriter struct {
+	w          io.Writer
+	interfaces map[string]uint32
+	// the number of bytes written to w
+	size int64
+}
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{
+		w:          w,
+		interfaces: make(map[string]uint32),
+	}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:4], PCAPNG_BYTE_ORDER_MAGIC)
+	binary.LittleEndian.PutUint16(body[4:6], 1) // major version
+	binary.LittleEndian.PutUint16(body[6:8], 0) // minor version
+	// section length is not specified
+	binary.LittleEndian.PutUint64(body[8:16], 0xffffffffffffffff)
+
+	if err := p.writeBlock(PCAPNG_BLOCK_TYPE_SHB, body, nil); err != nil {
+		return nil, fmt.Errorf("failed to write section header block: %w", err)
+	}
+	return p, nil
+}
+
+// interfaceID returns the id of netdev in this section, describing it if needed
+func (p *pcapngWriter) interfaceID(netdev *netDevice) (uint32, error) {
+	if id, ok := p.interfaces[netdev.name]; ok {
+		return id, nil
+	}
+
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], PCAPNG_LINKTYPE_ETHERNET)
+	// reserved and snaplen (0 means no limit) are left zero
+
+	options := []pcapngOption{
+		{code: PCAPNG_OPT_IF_NAME, value: []byte(netdev.name)},
+		{code: PCAPNG_OPT_IF_MACADDR, value: macToByte(netdev.macaddr)},
+		// timestamps are in nanoseconds
+		{code: PCAPNG_OPT_IF_TSRESOL, value: []byte{9}},
+	}
+	if netdev.ipdev().address != 0 {
+		options = append(options, pcapngOption{
+			code: PCAPNG_OPT_IF_DESCR,
+			value: []byte(fmt.Sprintf("%s/%d",
+				netdev.ipdev().address, subnetToPrefixLen(netdev.ipdev().netmask))),
+		})
+	}
+
+	if err := p.writeBlock(PCAPNG_BLOCK_TYPE_IDB, body, options); err != nil {
+		return 0, fmt.Errorf("failed to write interface description block: %w", err)
+	}
+
+	id := uint32(len(p.interfaces))
+	p.interfaces[netdev.name] = id
+	return id, nil
+}
+
+// writePacket writes the frame as an enhanced packet block
+func (p *pcapngWriter) writePacket(netdev *netDevice, ts time.Time, data []byte, direction captureDirection) error {
+	id, err := p.interfaceID(netdev)
+	if err != nil {
+		return err
+	}
+
+	tsnano := uint64(ts.UnixNano())
+	body := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(body[0:4], id)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(tsnano>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(tsnano))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+	body = appendPadding(body)
+
+	var options []pcapngOption
+	if direction != captureDirectionUnknown {
+		flags := make([]byte, 4)
+		// the lowest 2 bits are the direction
+		binary.LittleEndian.PutUint32(flags, uint32(direction))
+		options = append(options, pcapngOption{code: PCAPNG_OPT_EPB_FLAGS, value: flags})
+	}
+
+	if err := p.writeBlock(PCAPNG_BLOCK_TYPE_EPB, body, options); err != nil {
+		return fmt.Errorf("failed to write enhanced packet block: %w", err)
+	}
+	return nil
+}
+
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte, options []pcapngOption) error {
+	if len(options) > 0 {
+		for _, opt := range options {
+			body = binary.LittleEndian.AppendUint16(body, opt.code)
+			body = binary.LittleEndian.AppendUint16(body, uint16(len(opt.value)))
+			body = append(body, opt.value...)
+			body = appendPadding(body)
+		}
+		body = binary.LittleEndian.AppendUint16(body, PCAPNG_OPT_ENDOFOPT)
+		body = binary.LittleEndian.AppendUint16(body, 0)
+	}
+
+	// block type, block total length, body and block total length
+	totalLen := uint32(12 + len(body))
+	block := make([]byte, 0, totalLen)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, totalLen)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, totalLen)
+
+	n, err := p.w.Write(block)
+	p.size += int64(n)
+	return err
+}
+
+// appendPadding pads b to 32 bits boundary
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// proxyArpInterfaces are the interfaces which answer ARP requests for the addresses routed via other interfaces
+var proxyArpInterfaces []string
+
+var metricProxyArpReplies = newCounterVec(
+	"curo_arp_proxy_replies_total",
+	"Number of ARP replies sent on behalf of the addresses routed via other interfaces.",
+	"device",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricProxyArpReplies)
+}
+
+// setupProxyArp enables proxy ARP on the devices in netDeviceList
+func setupProxyArp() error {
+	// the hosts sending to the router would be black-holed
+	if len(proxyArpInterfaces) > 0 && !ipForwarding {
+		return fmt.Errorf("proxy ARP requires -ip-forward")
+	}
+	for _, name := range proxyArpInterfaces {
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("device %s is not found", name)
+		}
+		netdev.proxyArp = true
+		log.Printf("Enabled proxy ARP on %s", name)
+	}
+	return nil
+}
+
+// proxyArpTarget returns true when netdev answers the ARP request for the target
+// because the target is reachable via a different interface
+func proxyArpTarget(netdev *netDevice, arp arpIPToEthernet) bool {
+	if !netdev.proxyArp {
+		return false
+	}
+	// the probe and the gratuitous ARP of the host itself are not answered
+	if arp.senderIPAddr == 0 || arp.senderIPAddr == arp.targetIPAddr {
+		return false
+	}
+
+	outputdev := ipRouteOutputDevice(arp.targetIPAddr)
+	if outputdev == nil || outputdev == netdev {
+		return false
+	}
+	log.Printf("Proxying ARP on %s for %s via %s", netdev.name, arp.targetIPAddr, outputdev.name)
+	metricProxyArpReplies.inc(netdev.name)
+	return true
+}
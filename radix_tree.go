@@ -13,7 +13,8 @@ type radixTreeNode struct {
 func (n *radixTreeNode) radixTreeAdd(prefixIpAddr, prefixLen uint32, entryData ipRouteEntry) {
 	current := n
 
-	for d := 1; d < int(prefixLen); d++ {
+	// the entry is stored in the node at the depth of the prefix length
+	for d := 1; d <= int(prefixLen); d++ {
 		// check the first `d` bit
 		switch prefixIpAddr >> (32 - d) & 0x01 {
 		case 0:
@@ -36,14 +37,36 @@ func (n *radixTreeNode) radixTreeAdd(prefixIpAddr, prefixLen uint32, entryData i
 			current = current.node1
 		}
 	}
+	if current.data == (ipRouteEntry{}) {
+		metricRoutes.inc()
+	}
 	current.data = entryData
 }
 
-// nolint:unused
+// radixTreeDelete removes the entry stored at the prefix, keeping the nodes
+func (n *radixTreeNode) radixTreeDelete(prefixIpAddr, prefixLen uint32) {
+	current := n
+
+	for d := 1; d <= int(prefixLen); d++ {
+		if prefixIpAddr>>(32-d)&0x01 == 0 {
+			current = current.node0
+		} else {
+			current = current.node1
+		}
+		if current == nil {
+			return
+		}
+	}
+	if current.data != (ipRouteEntry{}) {
+		metricRoutes.dec()
+	}
+	current.data = ipRouteEntry{}
+}
+
 func (n *radixTreeNode) radixTreeSearch(prefixIpAddr uint32) (result ipRouteEntry) {
 	current := n
 
-	for i := 1; i < 32; i++ {
+	for i := 1; i <= 32; i++ {
 		if current.data != (ipRouteEntry{}) {
 			result = current.data
 		}
@@ -52,7 +75,7 @@ func (n *radixTreeNode) radixTreeSearch(prefixIpAddr uint32) (result ipRouteEntr
 			if current.node0 == nil {
 				return
 			}
-			current = current.node1
+			current = current.node0
 		case 1:
 			if current.node1 == nil {
 				return
@@ -60,6 +83,26 @@ func (n *radixTreeNode) radixTreeSearch(prefixIpAddr uint32) (result ipRouteEntr
 			current = current.node1
 		}
 	}
+	// host route
+	if current.data != (ipRouteEntry{}) {
+		result = current.data
+	}
 
 	return
 }
+
+// clone returns a deep copy of the tree under n, whose root is a child of parent
+func (n *radixTreeNode) clone(parent *radixTreeNode) *radixTreeNode {
+	if n == nil {
+		return nil
+	}
+	c := &radixTreeNode{
+		depth:  n.depth,
+		parent: parent,
+		data:   n.data,
+		value:  n.value,
+	}
+	c.node0 = n.node0.clone(c)
+	c.node1 = n.node1.clone(c)
+	return c
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+// TestRadixTreeLongestPrefixMatch checks that the search returns the route of the longest prefix
+// containing the address, including the prefixes which differ from each other only in their last bit
+// and the addresses which continue with a 0 bit after a shorter prefix
+func TestRadixTreeLongestPrefixMatch(t *testing.T) {
+	routes := []struct {
+		prefix    IpAddress
+		prefixLen uint32
+	}{
+		{0x0a000000, 8},  // 10.0.0.0/8
+		{0x0a000000, 9},  // 10.0.0.0/9
+		{0x0a800000, 9},  // 10.128.0.0/9
+		{0xc0a80000, 16}, // 192.168.0.0/16
+		{0xc0a80100, 24}, // 192.168.1.0/24
+		{0xc0a80100, 25}, // 192.168.1.0/25
+		{0xc0a80180, 25}, // 192.168.1.128/25
+		{0xc0a80101, 32}, // 192.168.1.1/32
+		{0xc0a801fe, 32}, // 192.168.1.254/32
+	}
+	tree := &radixTreeNode{}
+	for _, route := range routes {
+		// the next hop identifies the matched route
+		tree.radixTreeAdd(uint32(route.prefix), route.prefixLen, ipRouteEntry{
+			iptype:  IpRouteTypeNetwork,
+			nexthop: uint32(route.prefix) | route.prefixLen,
+		})
+	}
+
+	tests := []struct {
+		addr      IpAddress
+		prefix    IpAddress
+		prefixLen uint32
+	}{
+		{0x0a000001, 0x0a000000, 9},  // 10.0.0.1
+		{0x0a7fffff, 0x0a000000, 9},  // 10.127.255.255
+		{0x0a800001, 0x0a800000, 9},  // 10.128.0.1
+		{0xc0a80005, 0xc0a80000, 16}, // 192.168.0.5
+		{0xc0a80205, 0xc0a80000, 16}, // 192.168.2.5
+		{0xc0a80102, 0xc0a80100, 25}, // 192.168.1.2
+		{0xc0a80181, 0xc0a80180, 25}, // 192.168.1.129
+		{0xc0a80101, 0xc0a80101, 32}, // 192.168.1.1
+		{0xc0a80100, 0xc0a80100, 25}, // 192.168.1.0
+		{0xc0a801fe, 0xc0a801fe, 32}, // 192.168.1.254
+		{0xc0a801ff, 0xc0a80180, 25}, // 192.168.1.255
+	}
+	for _, tt := range tests {
+		route := tree.radixTreeSearch(uint32(tt.addr))
+		if want := uint32(tt.prefix) | tt.prefixLen; route.nexthop != want {
+			t.Errorf("route of %s = %s/%d, want %s/%d", tt.addr,
+				IpAddress(route.nexthop&^0xff), route.nexthop&0xff, tt.prefix, tt.prefixLen)
+		}
+	}
+
+	// no route matches without a default route
+	for _, addr := range []IpAddress{0x0b000001, 0xc0a90001} {
+		if route := tree.radixTreeSearch(uint32(addr)); route != (ipRouteEntry{}) {
+			t.Errorf("route of %s = %+v, want none", addr, route)
+		}
+	}
+
+	// the default route matches the addresses outside of the other prefixes
+	tree.radixTreeAdd(0, 0, ipRouteEntry{iptype: IpRouteTypeNetwork, nexthop: 0xc0a80001})
+	if route := tree.radixTreeSearch(0x0b000001); route.nexthop != 0xc0a80001 {
+		t.Errorf("route of 11.0.0.1 = %+v, want the default route", route)
+	}
+	if route := tree.radixTreeSearch(0xc0a80102); route.nexthop != 0xc0a80119 {
+		t.Errorf("route of 192.168.1.2 = %+v, want 192.168.1.0/25", route)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// how long the fragments of a datagram are kept (RFC 791 suggests 15 seconds at least)
+	ipReassemblyTimeout = 30 * time.Second
+	// the largest IP datagram
+	ipMaxDatagramLen = 0xffff
+)
+
+// ipReassemblyMemory bounds the bytes of the fragments waiting for reassembly
+var ipReassemblyMemory = 4 << 20
+
+type reassemblyKey struct {
+	srcAddr  IpAddress
+	dstAddr  IpAddress
+	protocol uint8
+	id       uint16
+}
+
+type ipFragmentData struct {
+	// the byte offset of data in the original payload
+	start int
+	data  []byte
+}
+
+func (f ipFragmentData) end() int {
+	return f.start + len(f.data)
+}
+
+// reassemblyDatagram is the datagram whose fragments are gathering
+type reassemblyDatagram struct {
+	key      reassemblyKey
+	inputdev *netDevice
+	// the header of the fragment at offset 0, nil until received
+	firstHeader []byte
+	// the packet of the fragment at offset 0 for ICMP time exceeded
+	firstPacket []byte
+	// the payload length known from the last fragment, -1 until received
+	payloadLen int
+	fragments  []ipFragmentData
+	size       int
+	expires    time.Time
+	elem       *list.Element
+}
+
+// reassemblyTable holds the datagrams in arrival order
+type reassemblyTable struct {
+	mu        sync.Mutex
+	datagrams map[reassemblyKey]*reassemblyDatagram
+	lru       *list.List
+	size      int
+}
+
+var ipReassembly = &reassemblyTable{
+	datagrams: make(map[reassemblyKey]*reassemblyDatagram),
+	lru:       list.New(),
+}
+
+var (
+	metricIPReassembly = newCounterVec(
+		"curo_ip_reassembly_total",
+		"Number of fragmented datagrams by the result of the reassembly.",
+		"result",
+	)
+	metricIPReassemblyBytes = newGauge(
+		"curo_ip_reassembly_bytes",
+		"Bytes of the fragments waiting for reassembly.",
+	)
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricIPReassembly, metricIPReassemblyBytes)
+	registerTimerHook(ipReassembly.expire)
+}
+
+// isIPFragment returns true when the packet is a fragment of a datagram
+func isIPFragment(ipheader *ipHeader) bool {
+	return ipheader.fragmentOffset&(IP_FLAG_MF|IP_FRAGMENT_OFFSET_MASK) != 0
+}
+
+// ipReassemble adds the fragment received on inputdev and returns the reassembled packet
+// when the datagram is complete, or nil while fragments are missing or the fragment is dropped.
+// Overlapping fragments other than exact duplicates drop the whole datagram.
+func ipReassemble(inputdev *netDevice, ipheader *ipHeader, packet []byte) []byte {
+	headerLen := int(ipheader.headerLen) * 4
+	if int(ipheader.totalLen) < headerLen || int(ipheader.totalLen) > len(packet) {
+		metricIPReassembly.inc("invalid")
+		dropPacket(inputdev, dropReasonIPFragmentInvalid, packet)
+		return nil
+	}
+	// the padding of the link layer is not the data
+	packet = packet[:ipheader.totalLen]
+	payload := packet[headerLen:]
+	start := int(ipheader.fragmentOffset&IP_FRAGMENT_OFFSET_MASK) * 8
+	more := ipheader.fragmentOffset&IP_FLAG_MF != 0
+
+	// the fragments other than the last carry a multiple of 8 bytes
+	if (more && len(payload)%8 != 0) || len(payload) == 0 || headerLen+start+len(payload) > ipMaxDatagramLen {
+		metricIPReassembly.inc("invalid")
+		dropPacket(inputdev, dropReasonIPFragmentInvalid, packet)
+		return nil
+	}
+
+	t := ipReassembly
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := reassemblyKey{
+		srcAddr:  ipheader.srcAddr,
+		dstAddr:  ipheader.destAddr,
+		protocol: ipheader.protocol,
+		id:       ipheader.identify,
+	}
+	dg, ok := t.datagrams[key]
+	if !ok {
+		dg = &reassemblyDatagram{
+			key:        key,
+			inputdev:   inputdev,
+			payloadLen: -1,
+			expires:    clock.Now().Add(ipReassemblyTimeout),
+		}
+		dg.elem = t.lru.PushBack(dg)
+		t.datagrams[key] = dg
+	}
+
+	fragment := ipFragmentData{start: start, data: append([]byte{}, payload...)}
+	if !more {
+		if dg.payloadLen >= 0 && dg.payloadLen != fragment.end() {
+			t.drop(dg, "overlap", dropReasonIPFragmentOverlap, packet)
+			return nil
+		}
+		dg.payloadLen = fragment.end()
+	}
+	if dg.payloadLen >= 0 && fragment.end() > dg.payloadLen {
+		t.drop(dg, "overlap", dropReasonIPFragmentOverlap, packet)
+		return nil
+	}
+
+	i := sort.Search(len(dg.fragments), func(i int) bool { return dg.fragments[i].start >= start })
+	if i < len(dg.fragments) && dg.fragments[i].start == start && string(dg.fragments[i].data) == string(fragment.data) {
+		// the duplicate is ignored
+		return nil
+	}
+	if (i > 0 && dg.fragments[i-1].end() > start) || (i < len(dg.fragments) && dg.fragments[i].start < fragment.end()) {
+		t.drop(dg, "overlap", dropReasonIPFragmentOverlap, packet)
+		return nil
+	}
+	dg.fragments = append(dg.fragments, ipFragmentData{})
+	copy(dg.fragments[i+1:], dg.fragments[i:])
+	dg.fragments[i] = fragment
+
+	if start == 0 {
+		dg.firstHeader = append([]byte{}, packet[:headerLen]...)
+		dg.firstPacket = append([]byte{}, packet...)
+	}
+	dg.size += len(packet)
+	t.size += len(packet)
+
+	if reassembled := dg.reassemble(); reassembled != nil {
+		t.remove(dg)
+		metricIPReassembly.inc("ok")
+		return reassembled
+	}
+
+	// the oldest datagrams are evicted under fragment floods
+	for t.size > ipReassemblyMemory {
+		oldest := t.lru.Front().Value.(*reassemblyDatagram)
+		t.drop(oldest, "evicted", dropReasonIPReassemblyMemory, oldest.firstPacket)
+		if oldest == dg {
+			break
+		}
+	}
+	return nil
+}
+
+// reassemble returns the packet when all fragments are received
+func (dg *reassemblyDatagram) reassemble() []byte {
+	if dg.firstHeader == nil || dg.payloadLen < 0 {
+		return nil
+	}
+	end := 0
+	for _, f := range dg.fragments {
+		if f.start != end {
+			return nil
+		}
+		end = f.end()
+	}
+	if end != dg.payloadLen {
+		return nil
+	}
+
+	packet := make([]byte, 0, len(dg.firstHeader)+dg.payloadLen)
+	packet = append(packet, dg.firstHeader...)
+	for _, f := range dg.fragments {
+		packet = append(packet, f.data...)
+	}
+	v := ipv4View(packet)
+	v.setTotalLen(uint16(len(packet)))
+	v.setFragmentOffset(v.fragmentOffset() & IP_FLAG_DF)
+	v.updateChecksum()
+	return packet
+}
+
+func (t *reassemblyTable) remove(dg *reassemblyDatagram) {
+	t.lru.Remove(dg.elem)
+	delete(t.datagrams, dg.key)
+	t.size -= dg.size
+	metricIPReassemblyBytes.set(t.size)
+}
+
+// drop discards the datagram for the result. packet is logged as the dropped packet.
+func (t *reassemblyTable) drop(dg *reassemblyDatagram, result string, reason dropReason, packet []byte) {
+	t.remove(dg)
+	metricIPReassembly.inc(result)
+	dropPacket(dg.inputdev, reason, packet)
+}
+
+// expire discards the datagrams which are not completed in time and sends ICMP time exceeded
+// for those whose first fragment has been received
+func (t *reassemblyTable) expire(now time.Time) {
+	var expired []*reassemblyDatagram
+
+	t.mu.Lock()
+	for front := t.lru.Front(); front != nil; front = t.lru.Front() {
+		dg := front.Value.(*reassemblyDatagram)
+		if now.Before(dg.expires) {
+			break
+		}
+		t.drop(dg, "timeout", dropReasonIPReassemblyTimeout, dg.firstPacket)
+		expired = append(expired, dg)
+	}
+	t.mu.Unlock()
+
+	for _, dg := range expired {
+		if dg.firstPacket == nil {
+			continue
+		}
+		ipheader := parseIPHeader(dg.firstPacket)
+		if err := icmpSendError(dg.inputdev, &ipheader, dg.firstPacket,
+			ICMP_TYPE_TIME_EXCEEDED, ICMP_CODE_FRAGMENT_REASSEMBLY_TIME_EXCEEDED, 0); err != nil {
+			log.Printf("failed to send ICMP time exceeded: %v", err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// replayOptions configures the replay mode
+var replayOptions struct {
+	input   string
+	output  string
+	ingress string
+	// virtual devices in the form of name=macaddr,address/prefix
+	devices []string
+}
+
+// runReplay feeds the frames recorded in a pcap file into the router
+// as if they were received on the ingress device.
+// The frames transmitted by the router are written to the output pcapng file.
+func runReplay() {
+	if replayOptions.input == "" || replayOptions.ingress == "" {
+		log.Fatalf("-pcap and -ingress are required in replay mode")
+	}
+
+	vclock := &virtualClock{}
+	clock = vclock
+
+	records, interfaces, err := readPcapFile(replayOptions.input)
+	if err != nil {
+		log.Fatalf("failed to read %s: %v", replayOptions.input, err)
+	}
+
+	for _, spec := range replayOptions.devices {
+		netdev, err := parseReplayDevice(spec)
+		if err != nil {
+			log.Fatalf("invalid replay device %q: %v", spec, err)
+		}
+		netDeviceList = append(netDeviceList, netdev)
+	}
+	// interfaces recorded by the capture of this router can be restored from pcapng
+	for _, iface := range interfaces {
+		if iface.name == "" || lookupNetDevice(iface.name) != nil {
+			continue
+		}
+		ipdev, err := iface.ipDevice()
+		if err != nil {
+			continue
+		}
+		netdev := &netDevice{
+			name:    iface.name,
+			macaddr: setMacAddr(iface.macaddr),
+			mtu:     IpDefaultMTU,
+			socket:  -1,
+			virtual: true,
+		}
+		netdev.setAddress(*ipdev)
+		netDeviceList = append(netDeviceList, netdev)
+	}
+
+	ingress := lookupNetDevice(replayOptions.ingress)
+	if ingress == nil {
+		log.Fatalf("ingress device %s is not defined, use -replay-device", replayOptions.ingress)
+	}
+
+	addStaticRoutes()
+	for _, netdev := range netDeviceList {
+		log.Printf("Created virtual device %s address %s ip %s",
+			netdev.name,
+			net.HardwareAddr(netdev.macaddr[:]).String(),
+			netdev.ipdev().address,
+		)
+		addConnectedRoute(netdev)
+	}
+
+	if err := setupMTU(); err != nil {
+		log.Fatalf("failed to set up MTU: %v", err)
+	}
+	if err := setupMirrorSessions(); err != nil {
+		log.Fatalf("failed to set up mirror sessions: %v", err)
+	}
+	if err := setupAccessLists(); err != nil {
+		log.Fatalf("failed to set up access lists: %v", err)
+	}
+	if err := setupFirewall(); err != nil {
+		log.Fatalf("failed to set up firewall: %v", err)
+	}
+	if err := setupURPF(); err != nil {
+		log.Fatalf("failed to set up uRPF: %v", err)
+	}
+	if err := setupArpInspection(); err != nil {
+		log.Fatalf("failed to set up ARP inspection: %v", err)
+	}
+	if err := setupProxyArp(); err != nil {
+		log.Fatalf("failed to set up proxy ARP: %v", err)
+	}
+
+	if replayOptions.output != "" {
+		if err := startCapture(captureConfig{path: replayOptions.output}); err != nil {
+			log.Fatalf("failed to start capture: %v", err)
+		}
+	}
+
+	var replayed, failed int
+	for _, record := range records {
+		// frames sent by the router in the original capture are not input
+		if record.direction == captureDirectionOutbound {
+			continue
+		}
+		vclock.set(record.timestamp)
+		runTimers(vclock.Now())
+
+		ingress.stats.rxPackets.Add(1)
+		ingress.stats.rxBytes.Add(uint64(len(record.data)))
+		replayed++
+		// replayed frames are mirrored like received ones
+		mirrorFrame(ingress, record.data, captureDirectionInbound)
+		// the frame is copied behind the headroom like a received one
+		pb := getPacketBuffer(packetBufferHeadroom, len(record.data))
+		copy(pb.append(len(record.data)), record.data)
+		if err := ingress.netDeviceInput(pb); err != nil {
+			failed++
+			log.Printf("failed to process packet %d on %s: %v", replayed, ingress.name, err)
+		}
+		pb.free()
+	}
+
+	if err := stopCapture(); err != nil {
+		log.Fatalf("failed to stop capture: %v", err)
+	}
+
+	var transmitted uint64
+	for _, netdev := range netDeviceList {
+		transmitted += netdev.stats.txPackets.Load()
+	}
+	log.Printf("Replayed %d frames (%d failed), transmitted %d frames", replayed, failed, transmitted)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseReplayDevice parses the virtual device, e.g. router1-host1=02:00:00:00:00:01,192.168.1.1/24
+func parseReplayDevice(spec string) (*netDevice, error) {
+	name, params, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("expected name=macaddr,address/prefix")
+	}
+	macstr, cidr, ok := strings.Cut(params, ",")
+	if !ok {
+		return nil, fmt.Errorf("expected name=macaddr,address/prefix")
+	}
+
+	macaddr, err := net.ParseMAC(macstr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse MAC address: %w", err)
+	}
+	ipdev, err := parseIPDevice(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	netdev := &netDevice{
+		name:    name,
+		macaddr: setMacAddr(macaddr),
+		mtu:     IpDefaultMTU,
+		socket:  -1,
+		virtual: true,
+	}
+	netdev.setAddress(*ipdev)
+	return netdev, nil
+}
+
+// lookupNetDevice returns the netDevice with the name
+func lookupNetDevice(name string) *netDevice {
+	for _, netdev := range netDeviceList {
+		if netdev.name == name {
+			return netdev
+		}
+	}
+	return nil
+}
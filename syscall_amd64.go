@@ -0,0 +1,4 @@
+package main
+
+// the number of the bpf syscall, which the syscall package does not define on amd64
+const sysBPF = 321
@@ -0,0 +1,5 @@
+package main
+
+import "syscall"
+
+const sysBPF = syscall.SYS_BPF
@@ -0,0 +1,23 @@
+//go:build !amd64 && !arm64
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// the packet rings and AF_XDP sockets are not set up on the other architectures
+const sysBPF = 0
+
+func setsockopt(socket, level, opt int, value unsafe.Pointer, size uintptr) error {
+	return syscall.ENOSYS
+}
+
+func getsockopt(socket, level, opt int, value unsafe.Pointer, size *uint32) error {
+	return syscall.ENOSYS
+}
+
+func bind(socket int, addr unsafe.Pointer, size uintptr) error {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,35 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The socket options and addresses the syscall package has no wrapper for.
+// The other architectures multiplex these syscalls and fall back to the plain sockets.
+
+func setsockopt(socket, level, opt int, value unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(socket), uintptr(level), uintptr(opt), uintptr(value), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func getsockopt(socket, level, opt int, value unsafe.Pointer, size *uint32) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(socket), uintptr(level), uintptr(opt), uintptr(value), uintptr(unsafe.Pointer(size)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func bind(socket int, addr unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(socket), uintptr(addr), size)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
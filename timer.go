@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// timerInterval is the longest the packet loop waits before running the timer hooks
+const timerInterval = 100 * time.Millisecond
+
+// timerHooks are run periodically by the packet loop with the router's time
+var timerHooks []func(now time.Time)
+
+func registerTimerHook(fn func(now time.Time)) {
+	timerHooks = append(timerHooks, fn)
+}
+
+func runTimers(now time.Time) {
+	for _, fn := range timerHooks {
+		fn(now)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// urpfOptions are the uRPF modes given on the command line, e.g. router1-host1=strict,router1-router2=loose
+var urpfOptions string
+
+type urpfMode uint8
+
+const (
+	urpfModeOff urpfMode = iota
+	// the route to the source must point back out the receiving interface
+	urpfModeStrict
+	// any route to the source must exist
+	urpfModeLoose
+)
+
+func (mode urpfMode) String() string {
+	switch mode {
+	case urpfModeStrict:
+		return "strict"
+	case urpfModeLoose:
+		return "loose"
+	default:
+		return "off"
+	}
+}
+
+var metricURPFDrops = newCounterVec(
+	"curo_urpf_drops_total",
+	"Number of packets dropped by the unicast reverse path forwarding check.",
+	"device", "mode",
+)
+
+func init() {
+	metricsRegistry = append(metricsRegistry, metricURPFDrops)
+}
+
+// setupURPF sets the uRPF mode of the devices in netDeviceList
+func setupURPF() error {
+	for _, param := range parseInterfaceList(urpfOptions) {
+		name, modestr, ok := strings.Cut(param, "=")
+		if !ok {
+			return fmt.Errorf("expected interface=strict|loose: %s", param)
+		}
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("device %s is not found", name)
+		}
+		switch modestr {
+		case "strict":
+			netdev.urpf = urpfModeStrict
+		case "loose":
+			netdev.urpf = urpfModeLoose
+		case "off":
+			netdev.urpf = urpfModeOff
+		default:
+			return fmt.Errorf("unknown uRPF mode: %s", modestr)
+		}
+		log.Printf("Set uRPF %s on %s", netdev.urpf, netdev.name)
+	}
+	return nil
+}
+
+// urpfCheck returns false when the source address of the packet received on inputdev fails the check
+func urpfCheck(inputdev *netDevice, ipheader *ipHeader, packet []byte) bool {
+	if inputdev.urpf == urpfModeOff {
+		return true
+	}
+	// the unspecified source is used before an address is configured, e.g. DHCP
+	if ipheader.srcAddr == 0 {
+		return true
+	}
+
+	outputdev := ipRouteOutputDevice(ipheader.srcAddr)
+	switch {
+	case outputdev == nil:
+	case inputdev.urpf == urpfModeLoose:
+		return true
+	case outputdev == inputdev:
+		return true
+	}
+
+	metricURPFDrops.inc(inputdev.name, inputdev.urpf.String())
+	dropPacket(inputdev, dropReasonURPFFailed, packet)
+	return false
+}
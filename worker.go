@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// The received frames of an interface are spread over the sockets of a PACKET_FANOUT group
+// by the flow hash, so that the frames of a flow stay in order on one worker.
+// Worker 0 receives on the primary socket of every device and also polls the AF_XDP sockets,
+// runs the timers and watches the shutdown signal. Worker N receives on queue N-1 of every device.
+// Any worker transmits on the primary socket of the output device under its txMu.
+
+const (
+	PACKET_FANOUT      = 18
+	PACKET_FANOUT_HASH = 0
+	PACKET_MR_ALLMULTI = 2
+)
+
+// packetWorkers is the number of goroutines receiving the frames. 0 runs a worker per CPU.
+var packetWorkers = 1
+
+// netQueue is an additional socket of the fanout group of netDevice, received by one worker
+type netQueue struct {
+	socket int
+	// the memory mapped rings of the socket, nil when a syscall is used per frame
+	ring *packetRing
+}
+
+// workerCount returns the number of the workers to run
+func workerCount() int {
+	if packetWorkers <= 0 {
+		return runtime.NumCPU()
+	}
+	return packetWorkers
+}
+
+// newPacketSocket opens the AF_PACKET socket bound to the interface
+func newPacketSocket(ifindex int) (int, syscall.SockaddrLinklayer, error) {
+	addr := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  ifindex,
+	}
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return -1, addr, fmt.Errorf("failed to create socket: %w", err)
+	}
+	if err := syscall.Bind(sock, &addr); err != nil {
+		if cerr := syscall.Close(sock); cerr != nil {
+			log.Printf("failed to close socket: %v", cerr)
+		}
+		return -1, addr, fmt.Errorf("failed to bind the interface to the socket: %w", err)
+	}
+	return sock, addr, nil
+}
+
+// joinAllMulticast makes the interface receive the frames to every multicast group
+// while the socket is open
+func joinAllMulticast(socket, ifindex int) error {
+	// struct packet_mreq
+	mreq := struct {
+		ifindex int32
+		mrType  uint16
+		alen    uint16
+		address [8]uint8
+	}{ifindex: int32(ifindex), mrType: PACKET_MR_ALLMULTI}
+	if err := setsockopt(socket, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq)); err != nil {
+		return fmt.Errorf("failed to receive all multicast: %w", err)
+	}
+	return nil
+}
+
+// joinFanout adds the socket to the fanout group of the interface
+func joinFanout(socket, ifindex int) error {
+	// the group id is 16 bits and unique per network namespace
+	arg := ifindex&0xffff | PACKET_FANOUT_HASH<<16
+	if err := syscall.SetsockoptInt(socket, syscall.SOL_PACKET, PACKET_FANOUT, arg); err != nil {
+		return fmt.Errorf("failed to join fanout group %d: %w", ifindex&0xffff, err)
+	}
+	return nil
+}
+
+// setupPacketQueues opens the sockets of the workers other than worker 0 on the devices in
+// netDeviceList and joins them to the fanout group with the primary socket. The devices whose
+// queues cannot be set up, and those on AF_XDP sockets, are received only by worker 0.
+func setupPacketQueues() {
+	workers := workerCount()
+	if workers <= 1 {
+		return
+	}
+	for _, netdev := range netDeviceList {
+		if netdev.virtual || netdev.socket < 0 || netdev.xsk != nil {
+			continue
+		}
+		if err := netdev.openQueues(workers - 1); err != nil {
+			log.Printf("failed to set up queues on %s, receiving only by worker 0: %v", netdev.name, err)
+			netdev.closeQueues()
+			continue
+		}
+		log.Printf("Set up %d queues on %s", workers, netdev.name)
+	}
+}
+
+// openQueues opens n sockets in the fanout group of netdev
+func (netdev *netDevice) openQueues(n int) error {
+	ifindex := netdev.sockaddr.Ifindex
+	if err := joinFanout(netdev.socket, ifindex); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		socket, _, err := newPacketSocket(ifindex)
+		if err != nil {
+			return err
+		}
+		q := &netQueue{socket: socket}
+		netdev.queues = append(netdev.queues, q)
+		// the socket receives every frame until it joins the group
+		if err := joinFanout(socket, ifindex); err != nil {
+			return err
+		}
+		if netdev.ring != nil {
+			if q.ring, err = newPacketRing(socket, netdev.maxFrameLen()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeQueues closes the queues of netdev
+func (netdev *netDevice) closeQueues() {
+	for _, q := range netdev.queues {
+		if err := q.close(); err != nil {
+			log.Printf("failed to close queue of %s: %v", netdev.name, err)
+		}
+	}
+	netdev.queues = nil
+}
+
+func (q *netQueue) close() error {
+	if q.socket < 0 {
+		return nil
+	}
+	if q.ring != nil {
+		if err := q.ring.close(); err != nil {
+			log.Printf("failed to close rings: %v", err)
+		}
+		q.ring = nil
+	}
+	err := syscall.Close(q.socket)
+	q.socket = -1
+	return err
+}
+
+// runPacketWorkers receives the frames by the workers until sigfd becomes readable or no
+// socket is left, and returns true when stopped by the signal. epfd monitors the sockets of
+// worker 0 and sigfd.
+func runPacketWorkers(mode string, epfd, sigfd int) bool {
+	workers := workerCount()
+	epfds := []int{epfd}
+	var active atomic.Int64
+	for _, netdev := range netDeviceList {
+		if netdev.socket >= 0 {
+			active.Add(1)
+		}
+	}
+
+	for id := 1; id < workers; id++ {
+		wepfd, err := syscall.EpollCreate1(0)
+		if err != nil {
+			log.Fatalf("epoll create err: %v", err)
+		}
+		epfds = append(epfds, wepfd)
+		fds := []int{sigfd}
+		for _, netdev := range netDeviceList {
+			if id <= len(netdev.queues) {
+				fds = append(fds, netdev.queues[id-1].socket)
+				active.Add(1)
+			}
+		}
+		for _, fd := range fds {
+			if err := syscall.EpollCtl(wepfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
+				Events: syscall.EPOLLIN,
+				Fd:     int32(fd),
+			}); err != nil {
+				log.Fatalf("failed to epoll ctrl: %v", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var stopping atomic.Bool
+	for id := range epfds {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if runPacketWorker(mode, id, epfds[id], sigfd, &active) {
+				stopping.Store(true)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	for _, wepfd := range epfds[1:] {
+		if err := syscall.Close(wepfd); err != nil {
+			log.Printf("failed to close epoll: %v", err)
+		}
+	}
+	return stopping.Load()
+}
+
+// runPacketWorker processes the frames received on the sockets of worker id monitored by epfd.
+// active is the number of the sockets which are still open on all workers.
+func runPacketWorker(mode string, id, epfd, sigfd int, active *atomic.Int64) bool {
+	events := make([]syscall.EpollEvent, 10)
+	for active.Load() > 0 {
+		nfds, err := syscall.EpollWait(epfd, events, int(timerInterval.Milliseconds()))
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Fatalf("failed to EpollWait: %v", err)
+		}
+		if id == 0 {
+			runTimers(clock.Now())
+		}
+		for i := 0; i < nfds; i++ {
+			// the signal pipe stays readable and stops every worker
+			if events[i].Fd == int32(sigfd) {
+				return true
+			}
+			if id == 0 && events[i].Fd == int32(addressWatchSocket) {
+				if err := pollAddressChanges(); err != nil {
+					log.Printf("%v", err)
+				}
+				continue
+			}
+
+			for _, netdev := range netDeviceList {
+				var err error
+				var socket int
+				switch {
+				case id == 0 && events[i].Fd == int32(netdev.socket):
+					socket = netdev.socket
+					err = netdev.netDevicePollSocket(mode, socket, netdev.ring, events[i].Events)
+				case id == 0 && netdev.xsk != nil && events[i].Fd == int32(netdev.xsk.socket):
+					socket = netdev.xsk.socket
+					err = netdev.netDevicePollXDP(mode)
+				case id > 0 && id <= len(netdev.queues) && events[i].Fd == int32(netdev.queues[id-1].socket):
+					q := netdev.queues[id-1]
+					socket = q.socket
+					err = netdev.netDevicePollSocket(mode, q.socket, q.ring, events[i].Events)
+				default:
+					continue
+				}
+				if err == nil {
+					continue
+				}
+				if isPacketError(err) {
+					log.Printf("failed to process packet on %s: %v", netdev.name, err)
+					continue
+				}
+
+				// the socket is unusable, stop polling only this socket
+				log.Printf("failed to net device poll, disabling %s on worker %d: %v", netdev.name, id, err)
+				if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_DEL, socket, nil); err != nil {
+					log.Printf("failed to remove %s from epoll: %v", netdev.name, err)
+				}
+				if id == 0 {
+					err = netdev.netDeviceClosePrimary()
+				} else {
+					err = netdev.queues[id-1].close()
+				}
+				if err != nil {
+					log.Printf("%v", err)
+				}
+				active.Add(-1)
+			}
+		}
+
+		// the frames queued while processing the batch are sent at once
+		for _, netdev := range netDeviceList {
+			if err := netdev.netDeviceFlush(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
+	return false
+}
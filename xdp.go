@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// AF_XDP sockets (Documentation/networking/af_xdp.rst). The XDP program attached to the
+// interface in generic mode redirects the frames of queue 0 to the socket, which receives
+// and transmits them through the UMEM shared by its rings. Generic mode works on any
+// interface including veth. The frames of the other queues are passed to the kernel
+// and received on the AF_PACKET socket as before.
+
+const (
+	AF_XDP  = 44
+	SOL_XDP = 283
+
+	XDP_MMAP_OFFSETS         = 1
+	XDP_RX_RING              = 2
+	XDP_TX_RING              = 3
+	XDP_UMEM_REG             = 4
+	XDP_UMEM_FILL_RING       = 5
+	XDP_UMEM_COMPLETION_RING = 6
+
+	XDP_PGOFF_RX_RING              = 0
+	XDP_PGOFF_TX_RING              = 0x80000000
+	XDP_UMEM_PGOFF_FILL_RING       = 0x100000000
+	XDP_UMEM_PGOFF_COMPLETION_RING = 0x180000000
+
+	// copy the frames between the UMEM and the device, which generic mode requires
+	XDP_COPY = 1 << 1
+	// attach the program in generic mode
+	XDP_FLAGS_SKB_MODE = 1 << 1
+	// the headroom the kernel reserves in front of the received frame in the chunk
+	XDP_PACKET_HEADROOM = 256
+	XDP_PASS            = 2
+
+	BPF_MAP_CREATE        = 0
+	BPF_MAP_UPDATE_ELEM   = 2
+	BPF_PROG_LOAD         = 5
+	BPF_LINK_CREATE       = 28
+	BPF_MAP_TYPE_XSKMAP   = 17
+	BPF_PROG_TYPE_XDP     = 6
+	BPF_XDP               = 37
+	BPF_PSEUDO_MAP_FD     = 1
+	BPF_FUNC_redirect_map = 51
+)
+
+const (
+	// the chunks of the UMEM, the first half is for RX and the other for TX
+	xdpFrameCount = 4096
+	xdpRingSize   = xdpFrameCount / 2
+	// the queued frames are sent when this many are pending
+	xdpTxBatchSize = 64
+)
+
+// xdpInterfaces are the interfaces which receive and transmit with AF_XDP sockets
+var xdpInterfaces []string
+
+type xdpRingOffset struct {
+	producer uint64
+	consumer uint64
+	desc     uint64
+	flags    uint64
+}
+
+// struct xdp_mmap_offsets
+type xdpMmapOffsets struct {
+	rx xdpRingOffset
+	tx xdpRingOffset
+	fr xdpRingOffset
+	cr xdpRingOffset
+}
+
+// struct xdp_umem_reg
+type xdpUmemReg struct {
+	addr          uint64
+	len           uint64
+	chunkSize     uint32
+	headroom      uint32
+	flags         uint32
+	txMetadataLen uint32
+}
+
+// struct sockaddr_xdp
+type sockaddrXDP struct {
+	family       uint16
+	flags        uint16
+	ifindex      uint32
+	queueID      uint32
+	sharedUmemFd uint32
+}
+
+// xdpRing is the ring shared with the kernel. We advance the index of one side
+// and keep it in cached until it is published.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    []byte
+	mask     uint32
+	cached   uint32
+}
+
+type xdpSocket struct {
+	socket    int
+	umem      []byte
+	chunkSize int
+
+	fill       xdpRing
+	completion xdpRing
+	rx         xdpRing
+	tx         xdpRing
+	// the TX chunks of the UMEM which can be filled
+	txFree    []uint64
+	txPending int
+	// the kernel has not taken all frames of the TX ring yet
+	txKick bool
+
+	// the XDP program is detached when the link is closed
+	mapFd  int
+	progFd int
+	linkFd int
+}
+
+// setupXDP opens the AF_XDP sockets of the devices in xdpInterfaces and monitors them by epfd.
+// The devices whose sockets cannot be opened keep using the AF_PACKET socket.
+func setupXDP(epfd int) error {
+	for _, name := range xdpInterfaces {
+		netdev := lookupNetDevice(name)
+		if netdev == nil {
+			return fmt.Errorf("device %s is not found", name)
+		}
+		xsk, err := newXDPSocket(netdev.sockaddr.Ifindex, netdev.maxFrameLen())
+		if err != nil {
+			log.Printf("failed to open AF_XDP socket on %s, falling back to AF_PACKET: %v", name, err)
+			continue
+		}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, xsk.socket, &syscall.EpollEvent{
+			Events: syscall.EPOLLIN,
+			Fd:     int32(xsk.socket),
+		}); err != nil {
+			if cerr := xsk.close(); cerr != nil {
+				log.Printf("%v", cerr)
+			}
+			return fmt.Errorf("failed to epoll ctrl: %w", err)
+		}
+		netdev.xsk = xsk
+		log.Printf("Opened AF_XDP socket on %s", name)
+	}
+	return nil
+}
+
+// newXDPSocket opens the AF_XDP socket on queue 0 of the interface for the frames up to frameLen bytes
+func newXDPSocket(ifindex, frameLen int) (*xdpSocket, error) {
+	if sysBPF == 0 {
+		return nil, syscall.ENOSYS
+	}
+
+	// the chunk size is a power of 2 from 2048 to the page size
+	chunkSize := 2048
+	if frameLen+XDP_PACKET_HEADROOM > chunkSize {
+		chunkSize = 4096
+	}
+	if frameLen+XDP_PACKET_HEADROOM > chunkSize {
+		return nil, fmt.Errorf("frame of %d bytes does not fit in the UMEM chunk", frameLen)
+	}
+
+	socket, err := syscall.Socket(AF_XDP, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+	x := &xdpSocket{
+		socket:    socket,
+		chunkSize: chunkSize,
+		mapFd:     -1,
+		progFd:    -1,
+		linkFd:    -1,
+	}
+	if err := x.open(ifindex); err != nil {
+		if cerr := x.close(); cerr != nil {
+			log.Printf("%v", cerr)
+		}
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xdpSocket) open(ifindex int) error {
+	umem, err := syscall.Mmap(-1, 0, xdpFrameCount*x.chunkSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return fmt.Errorf("failed to allocate UMEM: %w", err)
+	}
+	x.umem = umem
+
+	reg := xdpUmemReg{
+		addr:      uint64(uintptr(unsafe.Pointer(&umem[0]))),
+		len:       uint64(len(umem)),
+		chunkSize: uint32(x.chunkSize),
+	}
+	if err := setsockopt(x.socket, SOL_XDP, XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("failed to register UMEM: %w", err)
+	}
+	for _, opt := range []int{XDP_UMEM_FILL_RING, XDP_UMEM_COMPLETION_RING, XDP_RX_RING, XDP_TX_RING} {
+		if err := syscall.SetsockoptInt(x.socket, SOL_XDP, opt, xdpRingSize); err != nil {
+			return fmt.Errorf("failed to set ring size: %w", err)
+		}
+	}
+
+	var offsets xdpMmapOffsets
+	optlen := uint32(unsafe.Sizeof(offsets))
+	if err := getsockopt(x.socket, SOL_XDP, XDP_MMAP_OFFSETS, unsafe.Pointer(&offsets), &optlen); err != nil {
+		return fmt.Errorf("failed to get ring offsets: %w", err)
+	}
+	if x.fill, err = mapXDPRing(x.socket, XDP_UMEM_PGOFF_FILL_RING, offsets.fr, 8); err != nil {
+		return err
+	}
+	if x.completion, err = mapXDPRing(x.socket, XDP_UMEM_PGOFF_COMPLETION_RING, offsets.cr, 8); err != nil {
+		return err
+	}
+	if x.rx, err = mapXDPRing(x.socket, XDP_PGOFF_RX_RING, offsets.rx, 16); err != nil {
+		return err
+	}
+	if x.tx, err = mapXDPRing(x.socket, XDP_PGOFF_TX_RING, offsets.tx, 16); err != nil {
+		return err
+	}
+
+	// the RX chunks are given to the kernel and the TX chunks are kept free
+	for i := 0; i < xdpRingSize; i++ {
+		x.fill.setAddr(x.fill.cached, uint64(i*x.chunkSize))
+		x.fill.cached++
+	}
+	atomic.StoreUint32(x.fill.producer, x.fill.cached)
+	for i := xdpRingSize; i < xdpFrameCount; i++ {
+		x.txFree = append(x.txFree, uint64(i*x.chunkSize))
+	}
+
+	sa := sockaddrXDP{
+		family:  AF_XDP,
+		flags:   XDP_COPY,
+		ifindex: uint32(ifindex),
+	}
+	if err := bind(x.socket, unsafe.Pointer(&sa), unsafe.Sizeof(sa)); err != nil {
+		return fmt.Errorf("failed to bind: %w", err)
+	}
+
+	return x.attachProgram(ifindex)
+}
+
+// mapXDPRing maps the ring at pgoff whose entries are entrySize bytes
+func mapXDPRing(socket int, pgoff int64, offset xdpRingOffset, entrySize int) (xdpRing, error) {
+	mem, err := syscall.Mmap(socket, pgoff, int(offset.desc)+xdpRingSize*entrySize,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		return xdpRing{}, fmt.Errorf("failed to map ring: %w", err)
+	}
+	r := xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[offset.producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[offset.consumer])),
+		descs:    mem[offset.desc:],
+		mask:     xdpRingSize - 1,
+	}
+	return r, nil
+}
+
+// setAddr sets the address of the fill or completion ring entry at index
+func (r *xdpRing) setAddr(index uint32, addr uint64) {
+	*(*uint64)(unsafe.Pointer(&r.descs[(index&r.mask)*8])) = addr
+}
+
+func (r *xdpRing) addr(index uint32) uint64 {
+	return *(*uint64)(unsafe.Pointer(&r.descs[(index&r.mask)*8]))
+}
+
+// desc returns the struct xdp_desc of the RX or TX ring entry at index
+func (r *xdpRing) desc(index uint32) []byte {
+	i := (index & r.mask) * 16
+	return r.descs[i : i+16]
+}
+
+// struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapUpdateAttr struct {
+	mapFd uint32
+	_     uint32
+	key   unsafe.Pointer
+	value unsafe.Pointer
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              unsafe.Pointer
+	license            unsafe.Pointer
+	logLevel           uint32
+	logSize            uint32
+	logBuf             unsafe.Pointer
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+type bpfLinkCreateAttr struct {
+	progFd        uint32
+	targetIfindex uint32
+	attachType    uint32
+	flags         uint32
+}
+
+// attachProgram attaches the XDP program redirecting queue 0 to the socket in generic mode
+func (x *xdpSocket) attachProgram(ifindex int) error {
+	mapAttr := bpfMapCreateAttr{
+		mapType:    BPF_MAP_TYPE_XSKMAP,
+		keySize:    4,
+		valueSize:  4,
+		maxEntries: 1,
+	}
+	fd, _, errno := syscall.Syscall(uintptr(sysBPF), BPF_MAP_CREATE, uintptr(unsafe.Pointer(&mapAttr)), unsafe.Sizeof(mapAttr))
+	if errno != 0 {
+		return fmt.Errorf("failed to create XSKMAP: %w", errno)
+	}
+	x.mapFd = int(fd)
+
+	key := uint32(0)
+	value := uint32(x.socket)
+	updateAttr := bpfMapUpdateAttr{
+		mapFd: uint32(x.mapFd),
+		key:   unsafe.Pointer(&key),
+		value: unsafe.Pointer(&value),
+	}
+	if _, _, errno := syscall.Syscall(uintptr(sysBPF), BPF_MAP_UPDATE_ELEM, uintptr(unsafe.Pointer(&updateAttr)), unsafe.Sizeof(updateAttr)); errno != 0 {
+		return fmt.Errorf("failed to add socket to XSKMAP: %w", errno)
+	}
+
+	insns := []bpfInsn{
+		// r2 = ctx->rx_queue_index
+		{code: 0x61, regs: 1<<4 | 2, off: 16},
+		// r1 = the XSKMAP
+		{code: 0x18, regs: BPF_PSEUDO_MAP_FD<<4 | 1, imm: int32(x.mapFd)},
+		{},
+		// r3 = the action when the queue has no socket
+		{code: 0xb7, regs: 3, imm: XDP_PASS},
+		// return bpf_redirect_map(r1, r2, r3)
+		{code: 0x85, imm: BPF_FUNC_redirect_map},
+		{code: 0x95},
+	}
+	license := []byte("Dual MIT/GPL\x00")
+	progAttr := bpfProgLoadAttr{
+		progType:           BPF_PROG_TYPE_XDP,
+		insnCnt:            uint32(len(insns)),
+		insns:              unsafe.Pointer(&insns[0]),
+		license:            unsafe.Pointer(&license[0]),
+		expectedAttachType: BPF_XDP,
+	}
+	copy(progAttr.progName[:], "curo_xsk")
+	fd, _, errno = syscall.Syscall(uintptr(sysBPF), BPF_PROG_LOAD, uintptr(unsafe.Pointer(&progAttr)), unsafe.Sizeof(progAttr))
+	if errno != 0 {
+		return fmt.Errorf("failed to load XDP program: %w", errno)
+	}
+	x.progFd = int(fd)
+
+	linkAttr := bpfLinkCreateAttr{
+		progFd:        uint32(x.progFd),
+		targetIfindex: uint32(ifindex),
+		attachType:    BPF_XDP,
+		flags:         XDP_FLAGS_SKB_MODE,
+	}
+	fd, _, errno = syscall.Syscall(uintptr(sysBPF), BPF_LINK_CREATE, uintptr(unsafe.Pointer(&linkAttr)), unsafe.Sizeof(linkAttr))
+	if errno != 0 {
+		return fmt.Errorf("failed to attach XDP program: %w", errno)
+	}
+	x.linkFd = int(fd)
+	return nil
+}
+
+// receive calls handle with the frames in the RX ring and gives their chunks back
+// to the kernel by the fill ring. The frames must not be referenced after handle returns.
+// The first error of handle is returned after the batch.
+func (x *xdpSocket) receive(handle func(frame []byte, length int) error) error {
+	var firstErr error
+	producer := atomic.LoadUint32(x.rx.producer)
+	for ; x.rx.cached != producer; x.rx.cached++ {
+		// struct xdp_desc
+		desc := x.rx.desc(x.rx.cached)
+		addr := *(*uint64)(unsafe.Pointer(&desc[0]))
+		length := int(*(*uint32)(unsafe.Pointer(&desc[8])))
+		if err := handle(x.umem[addr:addr+uint64(length)], length); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		// the chunk holds as many entries as the fill ring, so there is always room
+		x.fill.setAddr(x.fill.cached, addr&^uint64(x.chunkSize-1))
+		x.fill.cached++
+	}
+	atomic.StoreUint32(x.rx.consumer, x.rx.cached)
+	atomic.StoreUint32(x.fill.producer, x.fill.cached)
+	return firstErr
+}
+
+// reclaim frees the TX chunks the kernel has completed
+func (x *xdpSocket) reclaim() {
+	producer := atomic.LoadUint32(x.completion.producer)
+	for ; x.completion.cached != producer; x.completion.cached++ {
+		x.txFree = append(x.txFree, x.completion.addr(x.completion.cached))
+	}
+	atomic.StoreUint32(x.completion.consumer, x.completion.cached)
+}
+
+// transmit copies data into a free chunk of the UMEM and queues it in the TX ring.
+// The frames are sent by flush or when a batch is pending.
+func (x *xdpSocket) transmit(data []byte) error {
+	if len(data) > x.chunkSize {
+		return fmt.Errorf("frame of %d bytes exceeds the UMEM chunk", len(data))
+	}
+	if len(x.txFree) == 0 {
+		x.reclaim()
+	}
+	if len(x.txFree) == 0 {
+		if err := x.flush(); err != nil {
+			return err
+		}
+		x.reclaim()
+		if len(x.txFree) == 0 {
+			return errTxRingFull
+		}
+	}
+
+	addr := x.txFree[len(x.txFree)-1]
+	x.txFree = x.txFree[:len(x.txFree)-1]
+	copy(x.umem[addr:], data)
+	desc := x.tx.desc(x.tx.cached)
+	*(*uint64)(unsafe.Pointer(&desc[0])) = addr
+	*(*uint32)(unsafe.Pointer(&desc[8])) = uint32(len(data))
+	*(*uint32)(unsafe.Pointer(&desc[12])) = 0
+	x.tx.cached++
+	x.txPending++
+
+	if x.txPending >= xdpTxBatchSize {
+		return x.flush()
+	}
+	return nil
+}
+
+// flush publishes the queued frames and wakes the kernel up to send them.
+// In copy mode the kernel sends a limited batch per syscall, so it is repeated
+// until the TX ring is drained.
+func (x *xdpSocket) flush() error {
+	if x.txPending == 0 && !x.txKick {
+		return nil
+	}
+	atomic.StoreUint32(x.tx.producer, x.tx.cached)
+	x.txPending = 0
+	x.txKick = false
+
+	for i := 0; atomic.LoadUint32(x.tx.consumer) != x.tx.cached; i++ {
+		if i == xdpRingSize {
+			// the device is busy, retried by the next flush
+			x.txKick = true
+			break
+		}
+		// the empty write on the non-blocking socket wakes the kernel up
+		_, err := syscall.Write(x.socket, nil)
+		switch err {
+		case nil, syscall.EAGAIN, syscall.EINTR:
+		case syscall.EBUSY, syscall.ENOBUFS:
+			x.txKick = true
+			x.reclaim()
+			return nil
+		default:
+			return fmt.Errorf("failed to send TX ring: %w", err)
+		}
+	}
+	x.reclaim()
+	return nil
+}
+
+// close sends the pending frames, detaches the XDP program and releases the socket
+func (x *xdpSocket) close() error {
+	var err error
+	if x.tx.mem != nil {
+		err = x.flush()
+	}
+	// closing the link detaches the program
+	for _, fd := range []int{x.linkFd, x.progFd, x.mapFd} {
+		if fd < 0 {
+			continue
+		}
+		if cerr := syscall.Close(fd); cerr != nil {
+			log.Printf("failed to close XDP program: %v", cerr)
+		}
+	}
+	x.linkFd, x.progFd, x.mapFd = -1, -1, -1
+	for _, r := range []*xdpRing{&x.fill, &x.completion, &x.rx, &x.tx} {
+		if r.mem == nil {
+			continue
+		}
+		if uerr := syscall.Munmap(r.mem); uerr != nil {
+			log.Printf("failed to unmap AF_XDP ring: %v", uerr)
+		}
+		*r = xdpRing{}
+	}
+	if x.socket >= 0 {
+		if cerr := syscall.Close(x.socket); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close AF_XDP socket: %w", cerr)
+		}
+		x.socket = -1
+	}
+	if x.umem != nil {
+		if uerr := syscall.Munmap(x.umem); uerr != nil {
+			log.Printf("failed to unmap UMEM: %v", uerr)
+		}
+		x.umem = nil
+	}
+	return err
+}